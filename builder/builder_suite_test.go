@@ -16,7 +16,8 @@ func TestDockerLifecycleBuilder(t *testing.T) {
 	BeforeSuite(func() {
 		var err error
 
-		builderPath, err = gexec.Build("code.cloudfoundry.org/dockerapplifecycle/builder")
+		// see package.go for the build tag
+		builderPath, err = gexec.Build("code.cloudfoundry.org/dockerapplifecycle/builder", "-tags", "containers_image_openpgp")
 		Expect(err).NotTo(HaveOccurred())
 	})
 
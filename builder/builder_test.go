@@ -1,6 +1,8 @@
 package main_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,14 +11,20 @@ import (
 	"os/exec"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
+	"code.cloudfoundry.org/dockerapplifecycle"
+	"code.cloudfoundry.org/dockerapplifecycle/testhelpers"
+	"code.cloudfoundry.org/tlsconfig"
 	"github.com/docker/libtrust"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/ghttp"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var _ = Describe("Building", func() {
@@ -29,10 +37,23 @@ var _ = Describe("Building", func() {
 		dockerRegistryPort         string
 		dockerDaemonExecutablePath string
 		cacheDockerImage           bool
+		pinDockerImageDigest       bool
 		dockerLoginServer          string
 		dockerUser                 string
 		dockerPassword             string
 		dockerEmail                string
+		platform                   string
+		signaturePolicy            string
+		dockerConfigJSON           string
+		dockerPasswordFile         string
+		dockerCertsDir             string
+		stagingTimeout             string
+		logFormat                  string
+		maxLayers                  string
+		admissionPolicy            string
+		dockerPasswordReader       *os.File
+		dockerPasswordFd           string
+		builderEnv                 []string
 		outputMetadataDir          string
 		outputMetadataJSONFilename string
 		fakeDockerRegistry         *ghttp.Server
@@ -110,6 +131,15 @@ var _ = Describe("Building", func() {
 		return resultInfo
 	}
 
+	failureJSON := func() dockerapplifecycle.StagingFailure {
+		contents, err := os.ReadFile(path.Join(outputMetadataDir, "failure.json"))
+		Expect(err).NotTo(HaveOccurred())
+
+		failure := dockerapplifecycle.StagingFailure{}
+		Expect(json.Unmarshal(contents, &failure)).To(Succeed())
+		return failure
+	}
+
 	BeforeEach(func() {
 		var err error
 
@@ -120,10 +150,23 @@ var _ = Describe("Building", func() {
 		dockerRegistryPort = ""
 		dockerDaemonExecutablePath = ""
 		cacheDockerImage = false
+		pinDockerImageDigest = false
 		dockerLoginServer = ""
 		dockerUser = ""
 		dockerPassword = ""
 		dockerEmail = ""
+		platform = ""
+		signaturePolicy = ""
+		dockerConfigJSON = ""
+		dockerPasswordFile = ""
+		dockerCertsDir = ""
+		stagingTimeout = ""
+		logFormat = ""
+		maxLayers = ""
+		admissionPolicy = ""
+		dockerPasswordReader = nil
+		dockerPasswordFd = ""
+		builderEnv = nil
 
 		outputMetadataDir, err = os.MkdirTemp("", "building-result")
 		Expect(err).NotTo(HaveOccurred())
@@ -158,6 +201,9 @@ var _ = Describe("Building", func() {
 		if cacheDockerImage {
 			args = append(args, "-cacheDockerImage")
 		}
+		if pinDockerImageDigest {
+			args = append(args, "-pinDockerImageDigest")
+		}
 		if len(dockerDaemonExecutablePath) > 0 {
 			args = append(args, "-dockerDaemonExecutablePath", dockerDaemonExecutablePath)
 		}
@@ -173,10 +219,46 @@ var _ = Describe("Building", func() {
 		if len(dockerEmail) > 0 {
 			args = append(args, "-dockerEmail", dockerEmail)
 		}
+		if len(platform) > 0 {
+			args = append(args, "-platform", platform)
+		}
+		if len(signaturePolicy) > 0 {
+			args = append(args, "-signaturePolicy", signaturePolicy)
+		}
+		if len(dockerConfigJSON) > 0 {
+			args = append(args, "-dockerConfigJSON", dockerConfigJSON)
+		}
+		if len(dockerPasswordFile) > 0 {
+			args = append(args, "-dockerPasswordFile", dockerPasswordFile)
+		}
+		if dockerPasswordReader != nil {
+			args = append(args, "-dockerPasswordFd", "3")
+		}
+		if len(dockerPasswordFd) > 0 {
+			args = append(args, "-dockerPasswordFd", dockerPasswordFd)
+		}
+		if len(dockerCertsDir) > 0 {
+			args = append(args, "-dockerCertsDir", dockerCertsDir)
+		}
+		if len(stagingTimeout) > 0 {
+			args = append(args, "-stagingTimeout", stagingTimeout)
+		}
+		if len(logFormat) > 0 {
+			args = append(args, "-logFormat", logFormat)
+		}
+		if len(maxLayers) > 0 {
+			args = append(args, "-maxLayers", maxLayers)
+		}
+		if len(admissionPolicy) > 0 {
+			args = append(args, "-admissionPolicy", admissionPolicy)
+		}
 
 		builderCmd = exec.Command(builderPath, args...)
 
-		builderCmd.Env = os.Environ()
+		builderCmd.Env = append(os.Environ(), builderEnv...)
+		if dockerPasswordReader != nil {
+			builderCmd.ExtraFiles = []*os.File{dockerPasswordReader}
+		}
 	})
 
 	// We rely on a secure docker registry providing a TLS certificate signed by
@@ -189,7 +271,88 @@ var _ = Describe("Building", func() {
 		It("fails to validate an HTTP registry", func() {
 			session := setupBuilder()
 			Eventually(session.Err).Should(gbytes.Say("server gave HTTP response to HTTPS client"))
-			Eventually(session).Should(gexec.Exit(2))
+			Eventually(session).Should(gexec.Exit(15))
+
+			failure := failureJSON()
+			Expect(failure.Code).To(Equal("TLS_ERROR"))
+			Expect(failure.Message).To(ContainSubstring("server gave HTTP response to HTTPS client"))
+			Expect(failure.Registry).To(Equal(fakeDockerRegistry.Addr()))
+			Expect(failure.Repo).To(Equal("some-repo"))
+			Expect(failure.Tag).To(Equal("latest"))
+		})
+	})
+
+	Context("when the registry uses a custom CA and requires a client certificate", func() {
+		var fixturesPath = path.Join("..", "helpers", "fixtures")
+
+		copyFixture := func(name, destination string) {
+			contents, err := os.ReadFile(path.Join(fixturesPath, name))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(destination, contents, 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			fakeDockerRegistry.Close()
+			fakeDockerRegistry = ghttp.NewUnstartedServer()
+
+			tlsConfig, err := tlsconfig.Build(
+				tlsconfig.WithInternalServiceDefaults(),
+				tlsconfig.WithIdentityFromFile(path.Join(fixturesPath, "localhost.cert"), path.Join(fixturesPath, "localhost.key")),
+			).Server(tlsconfig.WithClientAuthenticationFromFile(path.Join(fixturesPath, "testCA.crt")))
+			Expect(err).NotTo(HaveOccurred())
+			fakeDockerRegistry.HTTPTestServer.TLS = tlsConfig
+			fakeDockerRegistry.HTTPTestServer.StartTLS()
+
+			dockerRef = buildDockerRef()
+			fakeDockerRegistry.AllowUnhandledRequests = true
+			setupFakeDockerRegistry()
+			setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"]}}`))
+		})
+
+		AfterEach(func() {
+			fakeDockerRegistry.Close()
+		})
+
+		Context("with the CA and the client certificate in the certs directory", func() {
+			BeforeEach(func() {
+				dockerCertsDir = path.Join(outputMetadataDir, "certs.d")
+				parts, err := url.Parse(fakeDockerRegistry.URL())
+				Expect(err).NotTo(HaveOccurred())
+				hostCertsDir := path.Join(dockerCertsDir, parts.Host)
+				Expect(os.MkdirAll(hostCertsDir, 0755)).To(Succeed())
+
+				copyFixture("testCA.crt", path.Join(hostCertsDir, "ca.crt"))
+				copyFixture("localhost.cert", path.Join(hostCertsDir, "client.cert"))
+				copyFixture("localhost.key", path.Join(hostCertsDir, "client.key"))
+			})
+
+			It("should stage with TLS verification", func() {
+				session := setupBuilder()
+				Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+				Expect(resultJSON()).To(ContainSubstring(`\"cmd\":[\"-bazbot\",\"-foobar\"]`))
+			})
+		})
+
+		Context("without a certs directory", func() {
+			It("fails to verify the registry certificate", func() {
+				session := setupBuilder()
+				Eventually(session.Err, 10*time.Second).Should(gbytes.Say("certificate signed by unknown authority"))
+				Eventually(session, 10*time.Second).Should(gexec.Exit(15))
+			})
+		})
+
+		Context("with a certs directory that does not exist", func() {
+			BeforeEach(func() {
+				dockerCertsDir = path.Join(outputMetadataDir, "missing")
+			})
+
+			It("should exit with an error", func() {
+				session := setupBuilder()
+				Eventually(session.Err).Should(gbytes.Say("invalid docker certs directory: " + dockerCertsDir))
+				Eventually(session).Should(gexec.Exit(26))
+				Expect(failureJSON().Code).To(Equal("INVALID_CONFIGURATION"))
+			})
 		})
 	})
 
@@ -206,6 +369,7 @@ var _ = Describe("Building", func() {
 					session := setupBuilder()
 					Eventually(session.Err).Should(gbytes.Say("missing flag: dockerRef required"))
 					Eventually(session).Should(gexec.Exit(1))
+					Expect(path.Join(outputMetadataDir, "failure.json")).NotTo(BeAnExistingFile())
 				})
 			})
 
@@ -250,6 +414,493 @@ var _ = Describe("Building", func() {
 				})
 			})
 
+			Context("with an invalid docker ref", func() {
+				BeforeEach(func() {
+					dockerRef = "Some-Repo"
+				})
+
+				It("should exit with an error", func() {
+					session := setupBuilder()
+					Eventually(session.Err).Should(gbytes.Say(`invalid docker image reference \[Some-Repo\]: invalid reference format: repository name must be lowercase`))
+					Eventually(session).Should(gexec.Exit(24))
+
+					failure := failureJSON()
+					Expect(failure.Code).To(Equal("INVALID_REFERENCE"))
+					Expect(failure.Message).To(ContainSubstring("invalid docker image reference [Some-Repo]"))
+				})
+			})
+
+			Context("with a docker ref by digest", func() {
+				var manifestDigest digest.Digest
+
+				BeforeEach(func() {
+					response := makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"],"Entrypoint":["/dockerapp","-t"],"WorkingDir":"/workdir"}}`)
+					manifestDigest = digest.FromString(response)
+					dockerRef = buildDockerRef() + "@" + manifestDigest.String()
+
+					setupFakeDockerRegistry()
+					fakeDockerRegistry.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/"+manifestDigest.String()),
+							ghttp.RespondWith(http.StatusOK, response),
+						),
+					)
+				})
+
+				Describe("the json", func() {
+					It("should reference the image by digest", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+						result := resultJSON()
+
+						Expect(result).To(ContainSubstring(`"docker_image":"` + dockerRef + `"`))
+						Expect(result).To(ContainSubstring(`\"cmd\":[\"-bazbot\",\"-foobar\"]`))
+						Expect(path.Join(outputMetadataDir, "failure.json")).NotTo(BeAnExistingFile())
+					})
+				})
+			})
+
+			Context("with an image in an OCI layout", func() {
+				var manifestDigest digest.Digest
+
+				BeforeEach(func() {
+					layoutDir := path.Join(outputMetadataDir, "layout")
+					var err error
+					manifestDigest, err = testhelpers.WriteOCILayout(layoutDir, "1.0", v1.Image{
+						Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+						Config: v1.ImageConfig{
+							Entrypoint: []string{"/dockerapp"},
+							Cmd:        []string{"-bazbot", "-foobar"},
+						},
+						RootFS: v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{}},
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					dockerRef = "oci:" + layoutDir + ":1.0"
+					platform = "linux/amd64"
+				})
+
+				It("should refuse to stage the image without caching it", func() {
+					session := setupBuilder()
+					Eventually(session, 10*time.Second).Should(gexec.Exit(26))
+
+					failure := failureJSON()
+					Expect(failure.Code).To(Equal("INVALID_CONFIGURATION"))
+					Expect(failure.Message).To(ContainSubstring("must be cached in the docker registry"))
+				})
+
+				Context("when the image is cached", func() {
+					var cacheRegistry *testhelpers.FakeRegistry
+
+					BeforeEach(func() {
+						cacheRegistry = testhelpers.NewFakeRegistry()
+						cacheDockerImage = true
+						dockerRegistryHost, dockerRegistryPort, _ = net.SplitHostPort(cacheRegistry.Addr())
+					})
+
+					AfterEach(func() {
+						cacheRegistry.Close()
+					})
+
+					It("should stage the image without a source registry", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+						result := resultJSON()
+						Expect(result).To(ContainSubstring(`"docker_image":"` + cacheRegistry.Addr() + `/layout:1.0"`))
+						Expect(result).To(ContainSubstring(`"docker_image_digest":"` + manifestDigest.String() + `"`))
+						Expect(result).To(ContainSubstring(`\"cmd\":[\"-bazbot\",\"-foobar\"]`))
+					})
+
+					Context("when pinning the docker image digest", func() {
+						BeforeEach(func() {
+							pinDockerImageDigest = true
+						})
+
+						It("should reference the cached image by digest", func() {
+							session := setupBuilder()
+							Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+							Expect(resultJSON()).To(ContainSubstring(`"docker_image":"` + cacheRegistry.Addr() + `/layout@` + manifestDigest.String() + `"`))
+						})
+					})
+				})
+			})
+
+			Context("when the image does not exist", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+
+					setupFakeDockerRegistry()
+					fakeDockerRegistry.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/latest"),
+							ghttp.RespondWith(http.StatusNotFound, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`),
+						),
+					)
+				})
+
+				It("should write the failure with its own exit code", func() {
+					session := setupBuilder()
+					Eventually(session, 10*time.Second).Should(gexec.Exit(10))
+					Expect(outputMetadataJSONFilename).NotTo(BeAnExistingFile())
+
+					failure := failureJSON()
+					Expect(failure.Code).To(Equal("IMAGE_NOT_FOUND"))
+					Expect(failure.Message).To(ContainSubstring("manifest unknown"))
+					Expect(failure.Repo).To(Equal("some-repo"))
+					Expect(failure.Tag).To(Equal("latest"))
+				})
+
+				Context("with the json log format", func() {
+					BeforeEach(func() {
+						logFormat = "json"
+						dockerPassword = "s3cr3t-password"
+					})
+
+					It("should log one json event per line without secrets", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(10))
+						Expect(string(session.Err.Contents())).NotTo(ContainSubstring("s3cr3t-password"))
+
+						phases := []interface{}{}
+						for _, line := range strings.Split(strings.TrimSpace(string(session.Err.Contents())), "\n") {
+							event := map[string]interface{}{}
+							Expect(json.Unmarshal([]byte(line), &event)).To(Succeed(), line)
+							Expect(event).To(HaveKey("timestamp"))
+							Expect(event).To(HaveKey("level"))
+							phases = append(phases, event["phase"])
+						}
+						Expect(phases).To(ContainElements("auth", "manifest"))
+					})
+				})
+			})
+
+			Context("with process types in the image labels", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+
+					setupFakeDockerRegistry()
+				})
+
+				Context("that are valid", func() {
+					BeforeEach(func() {
+						setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["bin/web"],"Labels":{"org.cloudfoundry.process-types":"{\"worker\":\"bin/worker\"}","org.cloudfoundry.process.scheduler":"bin/scheduler"}}}`))
+					})
+
+					It("should stage all process types", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+						Expect(resultJSON()).To(ContainSubstring(`"process_types":{"scheduler":"bin/scheduler","web":"bin/web","worker":"bin/worker"}`))
+					})
+				})
+
+				Context("that are invalid", func() {
+					BeforeEach(func() {
+						setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["bin/web"],"Labels":{"org.cloudfoundry.process.worker":""}}}`))
+					})
+
+					It("should fail staging", func() {
+						session := setupBuilder()
+						Eventually(session.Err, 10*time.Second).Should(gbytes.Say(`empty start command for process type \[worker\]`))
+						Eventually(session, 10*time.Second).Should(gexec.Exit(22))
+						Expect(failureJSON().Code).To(Equal("INVALID_PROCESS_TYPES"))
+					})
+				})
+			})
+
+			Context("with a maximum number of layers", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+
+					setupFakeDockerRegistry()
+					setupRegistryResponse(`{
+						"schemaVersion": 1,
+						"name": "some-repo",
+						"tag": "latest",
+						"architecture": "amd64",
+						"fsLayers": [
+							{ "blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4" },
+							{ "blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4" }
+						],
+						"history": [
+							{ "v1Compatibility": "{\"id\":\"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9\",\"parent\":\"b3d2fb4a8c1cbd8b2ce5fe2b4d1c6f4c1d2f9f7a0b5d8e6c3a2b1f0e9d8c7b6a\",\"Config\":{\"Cmd\":[\"-bazbot\"]}}" },
+							{ "v1Compatibility": "{\"id\":\"b3d2fb4a8c1cbd8b2ce5fe2b4d1c6f4c1d2f9f7a0b5d8e6c3a2b1f0e9d8c7b6a\"}" }
+						]
+					}`)
+				})
+
+				Context("that the image exceeds", func() {
+					BeforeEach(func() {
+						maxLayers = "1"
+					})
+
+					It("should fail staging without downloading layers", func() {
+						session := setupBuilder()
+						Eventually(session.Err, 10*time.Second).Should(gbytes.Say(`image has 2 layers, more than the maximum of 1`))
+						Eventually(session, 10*time.Second).Should(gexec.Exit(21))
+						Expect(failureJSON().Code).To(Equal("TOO_MANY_LAYERS"))
+						Expect(outputMetadataJSONFilename).NotTo(BeAnExistingFile())
+						for _, request := range fakeDockerRegistry.ReceivedRequests() {
+							Expect(request.URL.Path).NotTo(ContainSubstring("/blobs/"))
+						}
+					})
+				})
+
+				Context("that the image stays within", func() {
+					BeforeEach(func() {
+						maxLayers = "2"
+					})
+
+					It("should stage the image", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+						Expect(resultJSON()).To(ContainSubstring(`"docker_image_layers":2`))
+					})
+				})
+			})
+
+			Context("when caching is requested without a docker registry", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+					cacheDockerImage = true
+				})
+
+				It("should exit with an error", func() {
+					session := setupBuilder()
+					Eventually(session.Err).Should(gbytes.Say("missing flag: dockerRegistryHost or dockerRegistryIPs required to cache docker images"))
+					Eventually(session).Should(gexec.Exit(1))
+				})
+			})
+
+			Context("when the docker registry cannot be reached for caching", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+					cacheDockerImage = true
+					dockerRegistryHost = "127.0.0.1"
+					dockerRegistryPort = "1"
+
+					setupFakeDockerRegistry()
+					setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"]}}`))
+					fakeDockerRegistry.AllowUnhandledRequests = true
+				})
+
+				It("should fail staging", func() {
+					session := setupBuilder()
+					Eventually(session.Err, 10*time.Second).Should(gbytes.Say(`failed to cache docker image \[` + dockerRef + `:latest\]`))
+					Eventually(session, 10*time.Second).Should(gexec.Exit(18))
+					Expect(failureJSON().Code).To(Equal("CACHE_FAILED"))
+				})
+			})
+
+			Context("with an invalid platform", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+					platform = "linux"
+				})
+
+				It("should exit with an error", func() {
+					session := setupBuilder()
+					Eventually(session.Err).Should(gbytes.Say(`invalid platform \[linux\]: expected os/arch\[/variant\]`))
+					Eventually(session).Should(gexec.Exit(25))
+
+					failure := failureJSON()
+					Expect(failure.Code).To(Equal("INVALID_PLATFORM"))
+					Expect(failure.Message).To(ContainSubstring("invalid platform [linux]"))
+				})
+			})
+
+			Context("with an admission policy", func() {
+				writeAdmissionPolicy := func(policy string) string {
+					policyPath := path.Join(outputMetadataDir, "admission.json")
+					Expect(os.WriteFile(policyPath, []byte(policy), 0644)).To(Succeed())
+					return policyPath
+				}
+
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+				})
+
+				Context("that denies the repository", func() {
+					BeforeEach(func() {
+						admissionPolicy = writeAdmissionPolicy(`{"deny":["` + fakeDockerRegistry.Addr() + `/some-*"]}`)
+					})
+
+					It("should fail staging without contacting the registry", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(23))
+						Expect(session.Err).To(gbytes.Say(`violates the admission policy: denied by \[` + fakeDockerRegistry.Addr() + `/some-\*\]`))
+						Expect(fakeDockerRegistry.ReceivedRequests()).To(BeEmpty())
+
+						failure := failureJSON()
+						Expect(failure.Code).To(Equal("POLICY_VIOLATION"))
+						Expect(failure.Message).To(ContainSubstring("violates the admission policy"))
+					})
+				})
+
+				Context("that allows the repository but requires a digest", func() {
+					BeforeEach(func() {
+						admissionPolicy = writeAdmissionPolicy(`{"allow":["` + fakeDockerRegistry.Addr() + `/**"],"require_digest":true}`)
+					})
+
+					It("should fail staging", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(23))
+						Expect(session.Err).To(gbytes.Say("images must be referenced by digest"))
+					})
+				})
+
+				Context("that allows the repository", func() {
+					BeforeEach(func() {
+						admissionPolicy = writeAdmissionPolicy(`{"allow":["` + fakeDockerRegistry.Addr() + `/some-repo"]}`)
+
+						setupFakeDockerRegistry()
+						setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"]}}`))
+					})
+
+					It("should stage the image", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+					})
+				})
+
+				Context("that is invalid", func() {
+					BeforeEach(func() {
+						admissionPolicy = writeAdmissionPolicy(`{"allow":[""]}`)
+					})
+
+					It("should exit with an error", func() {
+						session := setupBuilder()
+						Eventually(session.Err).Should(gbytes.Say(`invalid admission policy \[.*\]: empty pattern`))
+						Eventually(session).Should(gexec.Exit(26))
+						Expect(failureJSON().Code).To(Equal("INVALID_CONFIGURATION"))
+					})
+				})
+
+				Context("with a misspelt rule", func() {
+					BeforeEach(func() {
+						admissionPolicy = writeAdmissionPolicy(`{"deny_registry":["` + fakeDockerRegistry.Addr() + `/**"]}`)
+					})
+
+					It("should exit with an error instead of ignoring the rule", func() {
+						session := setupBuilder()
+						Eventually(session.Err).Should(gbytes.Say(`invalid admission policy \[.*\]: json: unknown field "deny_registry"`))
+						Eventually(session).Should(gexec.Exit(26))
+						Expect(failureJSON().Code).To(Equal("INVALID_CONFIGURATION"))
+						Expect(fakeDockerRegistry.ReceivedRequests()).To(BeEmpty())
+					})
+				})
+			})
+
+			Context("with a signature policy", func() {
+				writePolicy := func(policy string) string {
+					policyPath := path.Join(outputMetadataDir, "policy.json")
+					Expect(os.WriteFile(policyPath, []byte(policy), 0644)).To(Succeed())
+					return policyPath
+				}
+
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+				})
+
+				Context("that rejects the image", func() {
+					BeforeEach(func() {
+						signaturePolicy = writePolicy(`{"default":[{"type":"reject"}]}`)
+
+						setupFakeDockerRegistry()
+						setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"]}}`))
+						fakeDockerRegistry.AllowUnhandledRequests = true
+					})
+
+					It("should fail staging with the unmet requirement", func() {
+						session := setupBuilder()
+						Eventually(session.Err, 10*time.Second).Should(gbytes.Say(`image rejected by signature policy: Running image docker://` + dockerRef + `:latest is rejected by policy.`))
+						Eventually(session, 10*time.Second).Should(gexec.Exit(17))
+						Expect(failureJSON().Code).To(Equal("SIGNATURE_REJECTED"))
+						Expect(outputMetadataJSONFilename).NotTo(BeAnExistingFile())
+					})
+				})
+
+				Context("that accepts the image", func() {
+					BeforeEach(func() {
+						signaturePolicy = writePolicy(`{"default":[{"type":"insecureAcceptAnything"}]}`)
+
+						setupFakeDockerRegistry()
+						setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"]}}`))
+						fakeDockerRegistry.AllowUnhandledRequests = true
+					})
+
+					It("should exit successfully", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+					})
+				})
+
+				Context("that is invalid", func() {
+					BeforeEach(func() {
+						signaturePolicy = writePolicy(`{"default":[{"type":"no-such-requirement"}]}`)
+					})
+
+					It("should exit with an error", func() {
+						session := setupBuilder()
+						Eventually(session.Err).Should(gbytes.Say("invalid signature policy:"))
+						Eventually(session).Should(gexec.Exit(26))
+						Expect(failureJSON().Code).To(Equal("INVALID_CONFIGURATION"))
+					})
+				})
+			})
+
+			Context("when the registry does not respond", func() {
+				var release chan struct{}
+
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+					release = make(chan struct{})
+
+					setupFakeDockerRegistry()
+					fakeDockerRegistry.AppendHandlers(
+						func(w http.ResponseWriter, req *http.Request) {
+							select {
+							case <-release:
+							case <-req.Context().Done():
+							}
+						},
+					)
+					fakeDockerRegistry.AllowUnhandledRequests = true
+				})
+
+				AfterEach(func() {
+					close(release)
+				})
+
+				Context("with a staging timeout", func() {
+					BeforeEach(func() {
+						stagingTimeout = "500ms"
+					})
+
+					It("should fail staging without a result file", func() {
+						session := setupBuilder()
+						Eventually(session.Err, 5*time.Second).Should(gbytes.Say("staging timed out after 500ms"))
+						Eventually(session, 5*time.Second).Should(gexec.Exit(19))
+						Expect(failureJSON().Code).To(Equal("TIMEOUT"))
+						Expect(outputMetadataJSONFilename).NotTo(BeAnExistingFile())
+					})
+				})
+
+				Context("when the builder is interrupted", func() {
+					It("should stop staging without a result file", func() {
+						session := setupBuilder()
+						Eventually(fakeDockerRegistry.ReceivedRequests, 5*time.Second).Should(HaveLen(2))
+
+						session.Interrupt()
+						Eventually(session, 5*time.Second).Should(gexec.Exit(2))
+						Expect(session.Err).To(gbytes.Say("builder exited with error: interrupt"))
+						Expect(outputMetadataJSONFilename).NotTo(BeAnExistingFile())
+					})
+				})
+			})
+
 			testValid := func() {
 				Context("when the registry returns a signed manifest", func() {
 					BeforeEach(func() {
@@ -366,6 +1017,136 @@ var _ = Describe("Building", func() {
 							Expect(result).To(ContainSubstring(`\"workdir\":\"/workdir\"`))
 						})
 					})
+
+					It("should warn that the password flag is deprecated", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+						Expect(session.Err).To(gbytes.Say("-dockerPassword is deprecated"))
+					})
+
+					Context("when the password is read from a file", func() {
+						BeforeEach(func() {
+							dockerPasswordFile = path.Join(outputMetadataDir, "password")
+							Expect(os.WriteFile(dockerPasswordFile, []byte(dockerPassword+"\n"), 0600)).To(Succeed())
+							dockerPassword = ""
+						})
+
+						It("should exit successfully without a warning", func() {
+							session := setupBuilder()
+							Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+							Expect(session.Err).NotTo(gbytes.Say("is deprecated"))
+						})
+					})
+
+					Context("when the password is read from a file descriptor", func() {
+						var writer *os.File
+
+						BeforeEach(func() {
+							var err error
+							dockerPasswordReader, writer, err = os.Pipe()
+							Expect(err).NotTo(HaveOccurred())
+							_, err = writer.WriteString(dockerPassword)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(writer.Close()).To(Succeed())
+							dockerPassword = ""
+						})
+
+						AfterEach(func() {
+							dockerPasswordReader.Close()
+						})
+
+						It("should exit successfully", func() {
+							session := setupBuilder()
+							Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+						})
+					})
+
+					Context("when the password file descriptor is not open", func() {
+						BeforeEach(func() {
+							dockerPassword = ""
+							dockerPasswordFd = "42"
+						})
+
+						It("should exit with an error", func() {
+							session := setupBuilder()
+							Eventually(session.Err).Should(gbytes.Say("invalid docker password file descriptor 42: .*bad file descriptor"))
+							Eventually(session).Should(gexec.Exit(26))
+						})
+					})
+
+					Context("when the credentials are read from the environment", func() {
+						BeforeEach(func() {
+							builderEnv = []string{"CF_DOCKER_USER=" + dockerUser, "CF_DOCKER_PASSWORD=" + dockerPassword}
+							dockerUser = ""
+							dockerPassword = ""
+						})
+
+						It("should exit successfully", func() {
+							session := setupBuilder()
+							Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+						})
+					})
+				})
+
+				Context("when the password is supplied more than once", func() {
+					BeforeEach(func() {
+						builderEnv = []string{"CF_DOCKER_PASSWORD=" + dockerPassword}
+					})
+
+					It("should exit with an error", func() {
+						session := setupBuilder()
+						Eventually(session.Err).Should(gbytes.Say("only one of -dockerPassword, -dockerPasswordFile, -dockerPasswordFd or CF_DOCKER_PASSWORD can be set"))
+						Eventually(session).Should(gexec.Exit(26))
+						Expect(failureJSON().Code).To(Equal("INVALID_CONFIGURATION"))
+					})
+				})
+			})
+
+			Context("with credentials in a docker config file", func() {
+				BeforeEach(func() {
+					parts, err := url.Parse(fakeDockerRegistry.URL())
+					Expect(err).NotTo(HaveOccurred())
+					dockerRef = fmt.Sprintf("%s/some-repo", parts.Host)
+
+					auth := base64.StdEncoding.EncodeToString([]byte("configuser:configpassword"))
+					dockerConfigJSON = path.Join(outputMetadataDir, "config.json")
+					Expect(os.WriteFile(
+						dockerConfigJSON,
+						[]byte(fmt.Sprintf(`{"auths":{"http://%s/v2/":{"auth":"%s"}}}`, parts.Host, auth)),
+						0600,
+					)).To(Succeed())
+
+					authenticateHeader := http.Header{}
+					authenticateHeader.Add("WWW-Authenticate", `Basic realm="testRegistry"`)
+					fakeDockerRegistry.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/"),
+							ghttp.RespondWith(401, "", authenticateHeader),
+						),
+						ghttp.CombineHandlers(
+							ghttp.VerifyBasicAuth("configuser", "configpassword"),
+							ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/latest"),
+							ghttp.RespondWith(http.StatusOK, makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"]}}`)),
+						),
+					)
+				})
+
+				It("should authenticate with the matching entry", func() {
+					session := setupBuilder()
+					Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+				})
+
+				Context("when the file is not valid", func() {
+					BeforeEach(func() {
+						Expect(os.WriteFile(dockerConfigJSON, []byte("not-json"), 0600)).To(Succeed())
+					})
+
+					It("should exit with an error", func() {
+						session := setupBuilder()
+						Eventually(session.Err).Should(gbytes.Say(`invalid docker config \[` + dockerConfigJSON + `\]`))
+						Eventually(session).Should(gexec.Exit(26))
+						Expect(failureJSON().Code).To(Equal("INVALID_CONFIGURATION"))
+					})
 				})
 			})
 
@@ -465,7 +1246,8 @@ var _ = Describe("Building", func() {
 						It("should error", func() {
 							session := setupBuilder()
 							Eventually(session.Err).Should(gbytes.Say("value out of range"))
-							Eventually(session, 10*time.Second).Should(gexec.Exit(2))
+							Eventually(session, 10*time.Second).Should(gexec.Exit(16))
+							Expect(failureJSON().Code).To(Equal("INVALID_PORTS"))
 						})
 					})
 
@@ -477,7 +1259,7 @@ var _ = Describe("Building", func() {
 						It("should error", func() {
 							session := setupBuilder()
 							Eventually(session.Err).Should(gbytes.Say("invalid syntax"))
-							Eventually(session, 10*time.Second).Should(gexec.Exit(2))
+							Eventually(session, 10*time.Second).Should(gexec.Exit(16))
 						})
 					})
 
@@ -489,7 +1271,84 @@ var _ = Describe("Building", func() {
 						It("should error", func() {
 							session := setupBuilder()
 							Eventually(session.Err).Should(gbytes.Say("invalid syntax"))
-							Eventually(session, 10*time.Second).Should(gexec.Exit(2))
+							Eventually(session, 10*time.Second).Should(gexec.Exit(16))
+						})
+					})
+				})
+			})
+
+			Context("with environment variables in image metadata", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+					cacheDockerImage = false
+
+					setupFakeDockerRegistry()
+					setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"],"Entrypoint":["/dockerapp","-t"],"WorkingDir":"/workdir", "Env": ["PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8"]}}`))
+				})
+
+				Describe("the json", func() {
+					It("should contain the image environment", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+						result := resultJSON()
+
+						Expect(result).To(ContainSubstring(`\"env\":[\"PATH=/usr/local/bin:/usr/bin\",\"LANG=C.UTF-8\"]`))
+					})
+				})
+			})
+
+			Context("with the manifest digest", func() {
+				var manifestDigest digest.Digest
+
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+
+					setupFakeDockerRegistry()
+					response := makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"],"Entrypoint":["/dockerapp","-t"],"WorkingDir":"/workdir"}}`)
+					manifestDigest = digest.FromString(response)
+					setupRegistryResponse(response)
+				})
+
+				Describe("the json", func() {
+					It("should contain the digest and the tagged image", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+						result := resultJSON()
+
+						Expect(result).To(ContainSubstring(`"docker_image":"` + dockerRef + `:latest"`))
+						Expect(result).To(ContainSubstring(`"docker_image_digest":"` + manifestDigest.String() + `"`))
+					})
+
+					It("should describe the image manifest", func() {
+						session := setupBuilder()
+						Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+						result := resultJSON()
+
+						Expect(result).To(ContainSubstring(`"docker_image_layers":1`))
+						Expect(result).To(ContainSubstring(`"docker_image_media_type":"application/vnd.docker.distribution.manifest.v1+prettyjws"`))
+						// schema1 manifests record neither the layer sizes nor a config blob
+						Expect(result).NotTo(ContainSubstring(`"docker_image_size"`))
+						Expect(result).NotTo(ContainSubstring(`"docker_image_config_digest"`))
+					})
+				})
+
+				Context("when pinning the docker image digest", func() {
+					BeforeEach(func() {
+						pinDockerImageDigest = true
+					})
+
+					Describe("the json", func() {
+						It("should reference the image by digest", func() {
+							session := setupBuilder()
+							Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+							result := resultJSON()
+
+							Expect(result).To(ContainSubstring(`"docker_image":"` + dockerRef + `@` + manifestDigest.String() + `"`))
+							Expect(result).To(ContainSubstring(`"docker_image_digest":"` + manifestDigest.String() + `"`))
 						})
 					})
 				})
@@ -516,6 +1375,23 @@ var _ = Describe("Building", func() {
 				})
 
 			})
+
+			Context("with a stop signal in image metadata", func() {
+				BeforeEach(func() {
+					dockerRef = buildDockerRef()
+					cacheDockerImage = false
+
+					setupFakeDockerRegistry()
+					setupRegistryResponse(makeResponse(`{"id":"f8cbcf226d6a01a5ebb15b8390cff83b8b5dffc226761e968f9d3a01312551b9","Config":{"Cmd":["-bazbot","-foobar"],"Entrypoint":["/dockerapp","-t"],"StopSignal":"SIGQUIT"}}`))
+				})
+
+				It("should record the stop signal in the json", func() {
+					session := setupBuilder()
+					Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+
+					Expect(resultJSON()).To(ContainSubstring(`\"stop_signal\":\"SIGQUIT\"`))
+				})
+			})
 		})
 	})
 })
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+)
+
+const (
+	dockerUserEnv     = "CF_DOCKER_USER"
+	dockerPasswordEnv = "CF_DOCKER_PASSWORD"
+)
+
+// readDockerCredentials returns the registry credentials from the flags, a
+// password file or descriptor, or the environment. The environment variables
+// are removed once read so that they do not leak into child processes.
+func readDockerCredentials(logger *logging.Logger, user, password, passwordFile string, passwordFd int) (string, string, error) {
+	envUser := os.Getenv(dockerUserEnv)
+	envPassword := os.Getenv(dockerPasswordEnv)
+	os.Unsetenv(dockerUserEnv)
+	os.Unsetenv(dockerPasswordEnv)
+
+	if user == "" {
+		user = envUser
+	}
+
+	sources := 0
+	for _, set := range []bool{password != "", passwordFile != "", passwordFd >= 0, envPassword != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", "", fmt.Errorf(
+			"only one of -dockerPassword, -dockerPasswordFile, -dockerPasswordFd or %s can be set",
+			dockerPasswordEnv,
+		)
+	}
+
+	switch {
+	case passwordFile != "":
+		contents, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read docker password file: %s", err.Error())
+		}
+		password = string(contents)
+	case passwordFd >= 0:
+		file := os.NewFile(uintptr(passwordFd), "dockerPasswordFd")
+		defer file.Close()
+		// os.NewFile accepts any descriptor; a closed one only fails on use
+		_, err := file.Stat()
+		if err != nil {
+			return "", "", fmt.Errorf("invalid docker password file descriptor %d: %s", passwordFd, err.Error())
+		}
+
+		contents, err := io.ReadAll(file)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read docker password file descriptor: %s", err.Error())
+		}
+		password = string(contents)
+	case envPassword != "":
+		password = envPassword
+	case password != "":
+		logger.Warn(logging.PhaseAuth, fmt.Sprintf(
+			"-dockerPassword is deprecated as it exposes the password in the process list; use -dockerPasswordFile, -dockerPasswordFd or %s instead",
+			dockerPasswordEnv,
+		))
+	}
+
+	return user, strings.TrimRight(password, "\r\n"), nil
+}
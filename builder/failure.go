@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/dockerapplifecycle"
+	"code.cloudfoundry.org/dockerapplifecycle/staging"
+	"github.com/tedsuo/ifrit/grouper"
+)
+
+// failureExitCodes maps the failure codes to the exit code of the builder.
+// Failures that cannot be categorized exit with 2.
+var failureExitCodes = map[string]int{
+	dockerapplifecycle.FailureStagingFailed:       2,
+	dockerapplifecycle.FailureImageNotFound:       10,
+	dockerapplifecycle.FailureUnauthorized:        11,
+	dockerapplifecycle.FailureRateLimited:         12,
+	dockerapplifecycle.FailureRegistryUnavailable: 13,
+	dockerapplifecycle.FailureUnsupportedPlatform: 14,
+	dockerapplifecycle.FailureTLSError:            15,
+	dockerapplifecycle.FailureInvalidPorts:        16,
+	dockerapplifecycle.FailureSignatureRejected:   17,
+	dockerapplifecycle.FailureCacheFailed:         18,
+	dockerapplifecycle.FailureTimeout:             19,
+	dockerapplifecycle.FailureImageTooLarge:       20,
+	dockerapplifecycle.FailureTooManyLayers:       21,
+	dockerapplifecycle.FailureInvalidProcessTypes: 22,
+	dockerapplifecycle.FailurePolicyViolation:     23,
+	dockerapplifecycle.FailureInvalidReference:    24,
+	dockerapplifecycle.FailureInvalidPlatform:     25,
+	dockerapplifecycle.FailureInvalidConfig:       26,
+}
+
+// exitCode returns the exit code for the error of the builder process. The
+// exit trace of the group does not unwrap, so the builder error is looked up
+// in it.
+func exitCode(err error) int {
+	var trace grouper.ErrorTrace
+	if errors.As(err, &trace) {
+		for _, exit := range trace {
+			if exit.Err != nil {
+				return failureExitCodes[staging.FailureCode(exit.Err)]
+			}
+		}
+	}
+	return failureExitCodes[staging.FailureCode(err)]
+}
@@ -5,11 +5,16 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"strings"
 	"time"
 
+	"code.cloudfoundry.org/dockerapplifecycle"
 	"code.cloudfoundry.org/dockerapplifecycle/helpers"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+	"code.cloudfoundry.org/dockerapplifecycle/staging"
 	"code.cloudfoundry.org/ecrhelper"
+	"github.com/containers/image/v5/signature"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
 	"github.com/tedsuo/ifrit/sigmon"
@@ -27,7 +32,7 @@ func main() {
 	dockerRef := flagSet.String(
 		"dockerRef",
 		"",
-		"docker image reference in standard docker string format",
+		"docker image reference in standard docker string format, or the path of a local image prefixed with oci:, oci-archive:, docker-archive: or dir:, which must be cached with -cacheDockerImage",
 	)
 
 	outputFilename := flagSet.String(
@@ -36,6 +41,12 @@ func main() {
 		"filename in which to write the app metadata",
 	)
 
+	failureFilename := flagSet.String(
+		"outputFailureJSONFilename",
+		"",
+		"filename in which to write the failure code and message when staging fails (defaults to failure.json next to the app metadata); missing flags exit 1 without writing it",
+	)
+
 	flagSet.Var(
 		&insecureDockerRegistries,
 		"insecureDockerRegistries",
@@ -99,7 +110,19 @@ func main() {
 	dockerPassword := flagSet.String(
 		"dockerPassword",
 		"",
-		"Password for pulling from docker registry",
+		"Password for pulling from docker registry (deprecated: visible in the process list)",
+	)
+
+	dockerPasswordFile := flagSet.String(
+		"dockerPasswordFile",
+		"",
+		"path to a file containing the password for pulling from docker registry",
+	)
+
+	dockerPasswordFd := flagSet.Int(
+		"dockerPasswordFd",
+		-1,
+		"file descriptor to read the password for pulling from docker registry from",
 	)
 
 	dockerEmail := flagSet.String(
@@ -108,39 +131,226 @@ func main() {
 		"Email for pulling from docker registry",
 	)
 
+	pinDockerImageDigest := flagSet.Bool(
+		"pinDockerImageDigest",
+		false,
+		"Rewrites the staged docker image reference to repo@digest so that every instance runs the inspected image",
+	)
+
+	platform := flagSet.String(
+		"platform",
+		"",
+		"platform to select from multi-arch images in os/arch[/variant] format (defaults to the platform of the builder)",
+	)
+
+	stagingTimeout := flagSet.Duration(
+		"stagingTimeout",
+		0,
+		"maximum duration of staging, such as 15m (no limit by default)",
+	)
+
+	dockerRetryAttempts := flagSet.Int(
+		"dockerRetryAttempts",
+		helpers.DefaultRetryPolicy.MaxAttempts,
+		"maximum number of attempts for transient docker registry errors",
+	)
+
+	dockerRetryBackoff := flagSet.Duration(
+		"dockerRetryBackoff",
+		helpers.DefaultRetryPolicy.InitialBackoff,
+		"delay before the first retry of a docker registry request, doubled for every further retry",
+	)
+
+	dockerRetryMaxBackoff := flagSet.Duration(
+		"dockerRetryMaxBackoff",
+		helpers.DefaultRetryPolicy.MaxBackoff,
+		"maximum delay between retries of docker registry requests, also used when rate limited",
+	)
+
+	dockerCertsDir := flagSet.String(
+		"dockerCertsDir",
+		"",
+		"directory with host[:port] subdirectories holding ca.crt, client.cert and client.key for docker registries (defaults to the system certs.d directories)",
+	)
+
+	dockerConfigJSON := flagSet.String(
+		"dockerConfigJSON",
+		"",
+		"path to a docker config.json or Kubernetes .dockerconfigjson file with registry credentials",
+	)
+
+	signaturePolicy := flagSet.String(
+		"signaturePolicy",
+		"",
+		"path to a containers/image signature policy (policy.json) that staged images must satisfy",
+	)
+
+	maxImageSize := flagSet.Int64(
+		"maxImageSizeBytes",
+		0,
+		"maximum total compressed size of the image layers in bytes (no limit by default)",
+	)
+
+	maxLayers := flagSet.Int(
+		"maxLayers",
+		0,
+		"maximum number of image layers (no limit by default)",
+	)
+
+	admissionPolicy := flagSet.String(
+		"admissionPolicy",
+		"",
+		"path to a JSON admission policy with allow and deny globs for registry/repository, require_digest and forbid_latest_tag",
+	)
+
+	logFormat := flagSet.String(
+		"logFormat",
+		"text",
+		"format of the staging logs: text or json",
+	)
+
 	if err := flagSet.Parse(os.Args[1:len(os.Args)]); err != nil {
 		println(err.Error())
 		os.Exit(1)
 	}
 
-	var registryURL, repoName, tag string
-	if len(*dockerRef) > 0 {
-		registryURL, repoName, tag = helpers.ParseDockerRef(*dockerRef)
-	} else {
-		println("missing flag: dockerRef required")
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+	logger := logging.New(os.Stderr, format)
+
+	if len(*dockerRef) == 0 {
+		logger.Error("", "missing flag: dockerRef required")
+		flagSet.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *cacheDockerImage && len(*dockerRegistryHost) == 0 && len(dockerRegistryIPs) == 0 {
+		logger.Error("", "missing flag: dockerRegistryHost or dockerRegistryIPs required to cache docker images")
 		flagSet.PrintDefaults()
 		os.Exit(1)
 	}
 
+	if len(*failureFilename) == 0 {
+		*failureFilename = path.Join(path.Dir(*outputFilename), "failure.json")
+	}
+
+	// fail writes the failure document of an error found before staging
+	// starts and exits with the exit code of its failure code
+	var ref helpers.Reference
+	fail := func(phase logging.Phase, code string, err error) {
+		logger.Error(phase, err.Error())
+		failure := staging.Failure(ref, err)
+		failure.Code = code
+		if saveErr := helpers.SaveFailure(*failureFilename, failure); saveErr != nil {
+			logger.Error(logging.PhaseSave, fmt.Sprintf("Failed saving failure to %s: %s", *failureFilename, saveErr), logging.Data{
+				"filename": *failureFilename,
+				"error":    saveErr.Error(),
+			})
+		}
+		os.Exit(failureExitCodes[code])
+	}
+
+	ref, err = helpers.ParseDockerRef(*dockerRef)
+	if err != nil {
+		fail("", dockerapplifecycle.FailureInvalidReference, err)
+	}
+
+	targetPlatform, err := helpers.ParsePlatform(*platform)
+	if err != nil {
+		fail("", dockerapplifecycle.FailureInvalidPlatform, err)
+	}
+
+	var policy *signature.Policy
+	if len(*signaturePolicy) > 0 {
+		policy, err = signature.NewPolicyFromFile(*signaturePolicy)
+		if err != nil {
+			fail("", dockerapplifecycle.FailureInvalidConfig, errors.New("invalid signature policy: "+err.Error()))
+		}
+	}
+
+	user, password, err := readDockerCredentials(logger, *dockerUser, *dockerPassword, *dockerPasswordFile, *dockerPasswordFd)
+	if err != nil {
+		fail(logging.PhaseAuth, dockerapplifecycle.FailureInvalidConfig, err)
+	}
+	logger.Redact(password)
+
+	if *dockerRetryAttempts < 1 {
+		fail("", dockerapplifecycle.FailureInvalidConfig, errors.New("invalid flag: dockerRetryAttempts must be at least 1"))
+	}
+
+	if *maxImageSize < 0 || *maxLayers < 0 {
+		fail("", dockerapplifecycle.FailureInvalidConfig, errors.New("invalid flag: maxImageSizeBytes and maxLayers cannot be negative"))
+	}
+
+	if len(*dockerCertsDir) > 0 {
+		info, err := os.Stat(*dockerCertsDir)
+		if err != nil || !info.IsDir() {
+			fail("", dockerapplifecycle.FailureInvalidConfig, errors.New("invalid docker certs directory: "+*dockerCertsDir))
+		}
+	}
+
+	var admission *helpers.AdmissionPolicy
+	if len(*admissionPolicy) > 0 {
+		admission, err = helpers.LoadAdmissionPolicy(*admissionPolicy)
+		if err != nil {
+			fail("", dockerapplifecycle.FailureInvalidConfig, err)
+		}
+	}
+
+	var dockerConfig *helpers.DockerConfig
+	if len(*dockerConfigJSON) > 0 {
+		dockerConfig, err = helpers.LoadDockerConfig(*dockerConfigJSON)
+		if err != nil {
+			fail(logging.PhaseAuth, dockerapplifecycle.FailureInvalidConfig, err)
+		}
+	}
+
+	var credentials staging.CredentialProvider = staging.StaticCredentials{Username: user, Password: password}
+	if user == "" && password == "" && dockerConfig != nil {
+		credentials = dockerConfig
+	}
+
 	builder := Builder{
-		RegistryURL:                registryURL,
-		RepoName:                   repoName,
-		Tag:                        tag,
+		Options: staging.Options{
+			DockerRef:                ref,
+			InsecureDockerRegistries: insecureDockerRegistries,
+			Platform:                 targetPlatform,
+			Credentials: staging.ECRCredentials{
+				Helper:   ecrhelper.NewECRHelper(),
+				Username: user,
+				Password: password,
+				Next:     credentials,
+			},
+			DockerCertsDir:  *dockerCertsDir,
+			SignaturePolicy: policy,
+			AdmissionPolicy: admission,
+			RetryPolicy: helpers.RetryPolicy{
+				MaxAttempts:    *dockerRetryAttempts,
+				InitialBackoff: *dockerRetryBackoff,
+				MaxBackoff:     *dockerRetryMaxBackoff,
+			},
+			Timeout:                  *stagingTimeout,
+			MaxImageSize:             *maxImageSize,
+			MaxLayers:                *maxLayers,
+			PinDockerImageDigest:     *pinDockerImageDigest,
+			CacheDockerImage:         *cacheDockerImage,
+			DockerRegistryIPs:        dockerRegistryIPs,
+			DockerRegistryHost:       *dockerRegistryHost,
+			DockerRegistryPort:       *dockerRegistryPort,
+			DockerRegistryRequireTLS: *dockerRegistryRequireTLS,
+			Logger:                   logger,
+		},
 		OutputFilename:             *outputFilename,
+		FailureFilename:            *failureFilename,
 		DockerDaemonExecutablePath: *dockerDaemonExecutablePath,
-		InsecureDockerRegistries:   insecureDockerRegistries,
 		DockerDaemonTimeout:        10 * time.Second,
 		DockerDaemonUnixSocket:     *dockerDaemonUnixSocket,
-		CacheDockerImage:           *cacheDockerImage,
-		DockerRegistryIPs:          dockerRegistryIPs,
-		DockerRegistryHost:         *dockerRegistryHost,
-		DockerRegistryPort:         *dockerRegistryPort,
-		DockerRegistryRequireTLS:   *dockerRegistryRequireTLS,
 		DockerLoginServer:          *dockerLoginServer,
-		DockerUser:                 *dockerUser,
-		DockerPassword:             *dockerPassword,
 		DockerEmail:                *dockerEmail,
-		ECRHelper:                  ecrhelper.NewECRHelper(),
+		Logger:                     logger,
 	}
 
 	members := grouper.Members{
@@ -150,15 +360,16 @@ func main() {
 	group := grouper.NewParallel(os.Interrupt, members)
 	process := ifrit.Invoke(sigmon.New(group))
 
-	fmt.Println("Staging process started ...")
+	stdout := logging.New(os.Stdout, format)
+	stdout.Info("", "Staging process started ...")
 
-	err := <-process.Wait()
+	err = <-process.Wait()
 	if err != nil {
-		println("Staging process failed:", err.Error())
-		os.Exit(2)
+		logger.Error("", "Staging process failed: "+err.Error())
+		os.Exit(exitCode(err))
 	}
 
-	fmt.Println("Staging process finished")
+	stdout.Info("", "Staging process finished")
 }
 
 func (r *registries) String() string {
@@ -1 +1,7 @@
+// The builder stages docker images. It verifies image signatures with the
+// OpenPGP implementation of containers/image rather than GPGME, which needs
+// cgo and libgpgme, so it is built with the containers_image_openpgp build
+// tag:
+//
+//	go build -tags containers_image_openpgp code.cloudfoundry.org/dockerapplifecycle/builder
 package main // import "code.cloudfoundry.org/dockerapplifecycle/builder"
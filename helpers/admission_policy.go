@@ -0,0 +1,123 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// AdmissionPolicy restricts the images that may be staged. Allow and Deny hold
+// glob patterns matched against "registry/repository", where "*" matches
+// within a path segment and "**" across segments. Images from Docker Hub match
+// with both "docker.io" and "registry-1.docker.io" as the registry.
+type AdmissionPolicy struct {
+	Allow           []string `json:"allow,omitempty"`
+	Deny            []string `json:"deny,omitempty"`
+	RequireDigest   bool     `json:"require_digest,omitempty"`
+	ForbidLatestTag bool     `json:"forbid_latest_tag,omitempty"`
+}
+
+// PolicyViolationError is returned when an image reference is rejected by the
+// admission policy.
+type PolicyViolationError struct {
+	Reference Reference
+	Reason    string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return fmt.Sprintf("image [%s] violates the admission policy: %s", e.Reference, e.Reason)
+}
+
+// LoadAdmissionPolicy reads a policy from a JSON file. Unknown keys are
+// rejected, as a misspelt rule would otherwise be silently ignored.
+func LoadAdmissionPolicy(filename string) (*AdmissionPolicy, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &AdmissionPolicy{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admission policy [%s]: %s", filename, err.Error())
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid admission policy [%s]: unexpected data after the policy", filename)
+	}
+
+	for _, pattern := range append(policy.Allow, policy.Deny...) {
+		if pattern == "" {
+			return nil, fmt.Errorf("invalid admission policy [%s]: empty pattern", filename)
+		}
+	}
+	return policy, nil
+}
+
+// Check evaluates the policy against the parsed reference only, so that
+// rejected images are never contacted. Deny rules win over allow rules, and
+// an empty allow list allows every image that is not denied. Images on the
+// file system are matched by their full reference, such as "oci:/images/app".
+func (p *AdmissionPolicy) Check(ref Reference) error {
+	names := []string{ref.RegistryURL + "/" + ref.RepoName}
+	if ref.IsLocal() {
+		names = []string{ref.String()}
+	}
+	if ref.RegistryURL == DockerHubHostname {
+		names = append(names, dockerHubDomain+"/"+ref.RepoName)
+	}
+
+	if pattern := matchGlobs(p.Deny, names); pattern != "" {
+		return &PolicyViolationError{Reference: ref, Reason: fmt.Sprintf("denied by [%s]", pattern)}
+	}
+	if len(p.Allow) > 0 && matchGlobs(p.Allow, names) == "" {
+		return &PolicyViolationError{Reference: ref, Reason: "not in the allowed registries and repositories"}
+	}
+	if p.RequireDigest && ref.Digest == "" {
+		return &PolicyViolationError{Reference: ref, Reason: "images must be referenced by digest"}
+	}
+	if p.ForbidLatestTag && !ref.IsLocal() && ref.Digest == "" && ref.Tag == "latest" {
+		return &PolicyViolationError{Reference: ref, Reason: "the latest tag is not allowed"}
+	}
+	return nil
+}
+
+// globToRegexp translates a glob pattern into an anchored regular expression.
+func globToRegexp(pattern string) *regexp.Regexp {
+	runes := []rune(pattern)
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(runes); i++ {
+		switch {
+		case runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '*':
+			expr.WriteString(".*")
+			i++
+		case runes[i] == '*':
+			expr.WriteString("[^/]*")
+		case runes[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// matchGlobs returns the first pattern that matches any of the names.
+func matchGlobs(patterns []string, names []string) string {
+	for _, pattern := range patterns {
+		re := globToRegexp(pattern)
+		for _, name := range names {
+			if re.MatchString(name) {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
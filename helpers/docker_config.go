@@ -0,0 +1,150 @@
+package helpers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+)
+
+const (
+	dockerHubIndexHostname = "index.docker.io"
+	identityTokenUsername  = "<token>"
+	credentialHelperPrefix = "docker-credential-"
+)
+
+// DockerConfig holds the registry credentials of a docker config.json file or
+// of the .dockerconfigjson key of a Kubernetes image pull secret.
+type DockerConfig struct {
+	Auths       map[string]DockerConfigAuth `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers,omitempty"`
+	CredsStore  string                      `json:"credsStore,omitempty"`
+}
+
+// DockerConfigAuth is a single entry of the "auths" section.
+type DockerConfigAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+func LoadDockerConfig(filename string) (*DockerConfig, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &DockerConfig{}
+	err = json.Unmarshal(contents, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker config [%s]: %s", filename, err.Error())
+	}
+	return config, nil
+}
+
+// Credentials returns the credentials for registryURL. A credHelpers entry for
+// the registry wins over the auths entries, and the credsStore is used when the
+// auths entries hold no credentials for the registry. Empty credentials are
+// returned when nothing matches.
+func (c *DockerConfig) Credentials(registryURL string) (types.DockerAuthConfig, error) {
+	registry := normalizeRegistryHost(registryURL)
+
+	for key, helper := range c.CredHelpers {
+		if normalizeRegistryHost(key) == registry {
+			return credentialsFromHelper(helper, registryServerURL(registryURL))
+		}
+	}
+
+	authConfig, err := c.authsCredentials(registryURL)
+	if err != nil {
+		return types.DockerAuthConfig{}, err
+	}
+	if authConfig != (types.DockerAuthConfig{}) || c.CredsStore == "" {
+		return authConfig, nil
+	}
+	return credentialsFromHelper(c.CredsStore, registryServerURL(registryURL))
+}
+
+func (c *DockerConfig) authsCredentials(registryURL string) (types.DockerAuthConfig, error) {
+	if auth, ok := c.Auths[registryURL]; ok {
+		return auth.credentials(registryURL)
+	}
+
+	registry := normalizeRegistryHost(registryURL)
+	for key, auth := range c.Auths {
+		if normalizeRegistryHost(key) == registry {
+			return auth.credentials(key)
+		}
+	}
+	return types.DockerAuthConfig{}, nil
+}
+
+func (a DockerConfigAuth) credentials(key string) (types.DockerAuthConfig, error) {
+	authConfig := types.DockerAuthConfig{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+	}
+
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return types.DockerAuthConfig{}, fmt.Errorf("invalid auth for registry [%s] in docker config: %s", key, err.Error())
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return types.DockerAuthConfig{}, fmt.Errorf("invalid auth for registry [%s] in docker config: expected username:password", key)
+		}
+		authConfig.Username = username
+		authConfig.Password = password
+	}
+	return authConfig, nil
+}
+
+func credentialsFromHelper(helper, serverURL string) (types.DockerAuthConfig, error) {
+	creds, err := client.Get(client.NewShellProgramFunc(credentialHelperPrefix+helper), serverURL)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return types.DockerAuthConfig{}, nil
+	}
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("credential helper [%s] failed for [%s]: %s", helper, serverURL, err.Error())
+	}
+
+	if creds.Username == identityTokenUsername {
+		return types.DockerAuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return types.DockerAuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// normalizeRegistryHost turns a registry address or login server URL, such as
+// "https://index.docker.io/v1/", into a host name. The Docker Hub aliases are
+// mapped to a single name.
+func normalizeRegistryHost(registry string) string {
+	host := registry
+	if strings.Contains(host, "://") {
+		_, host, _ = strings.Cut(host, "://")
+	}
+	host, _, _ = strings.Cut(host, "/")
+
+	switch host {
+	case DockerHubHostname, dockerHubDomain, dockerHubIndexHostname:
+		return dockerHubIndexHostname
+	}
+	return host
+}
+
+// registryServerURL is the server URL that credential helpers expect, which is
+// the legacy login server for Docker Hub and the host name otherwise.
+func registryServerURL(registryURL string) string {
+	host := normalizeRegistryHost(registryURL)
+	if host == dockerHubIndexHostname {
+		return DockerHubLoginServer
+	}
+	return host
+}
@@ -3,18 +3,24 @@ package helpers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path"
+	"runtime"
 	"strings"
 
 	"code.cloudfoundry.org/dockerapplifecycle"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
 	"code.cloudfoundry.org/dockerapplifecycle/protocol"
+	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/image"
 	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -22,60 +28,138 @@ const (
 	DockerHubHostname    = "registry-1.docker.io"
 	DockerHubLoginServer = "https://index.docker.io/v1/"
 	MAX_DOCKER_RETRIES   = 4
+
+	dockerHubDomain = "docker.io"
 )
 
-// borrowed from docker/docker
-func splitReposName(reposName string) (string, string) {
-	nameParts := strings.SplitN(reposName, "/", 2)
-	var hostname, repoName string
-	if len(nameParts) == 1 || (!strings.Contains(nameParts[0], ".") &&
-		!strings.Contains(nameParts[0], ":") && nameParts[0] != "localhost") {
-		// This is a Docker Index repos (ex: samalba/hipache or ubuntu)
-		// 'docker.io' in docker/docker codebase, but they use indices...
-		hostname = DockerHubHostname
-		repoName = reposName
-	} else {
-		hostname = nameParts[0]
-		repoName = nameParts[1]
-	}
-	return hostname, repoName
+// ErrSignatureRejected is returned when an image does not satisfy the
+// signature policy.
+var ErrSignatureRejected = errors.New("image rejected by signature policy")
+
+// Reference is a docker image reference split into the parts needed to
+// contact the registry. References to images on the file system name their
+// Transport and the transport specific Path; their RepoName and Tag are used
+// when the image is cached.
+type Reference struct {
+	Transport   string
+	Path        string
+	RegistryURL string
+	RepoName    string
+	Tag         string
+	Digest      digest.Digest
 }
 
-// For standard docker image references expressed as a protocol-less string
-// returns RegistryURL, repoName, tag|digest
-func ParseDockerRef(dockerRef string) (string, string, string) {
-	remote, tag := ParseRepositoryTag(dockerRef)
-	hostname, repoName := splitReposName(remote)
+// ParseDockerRef parses a standard docker image reference expressed as a
+// protocol-less string, such as "redis", "localhost:5000/foo/bar:1.0",
+// "ubuntu@sha256:..." or "ubuntu:22.04@sha256:...". References without a tag
+// or a digest default to the "latest" tag. Images on the file system are
+// referenced with a containers/image transport and a path, such as
+// "oci:/images/app:1.0", "oci-archive:./app.tar", "docker-archive:/app.tar"
+// or "dir:/images/app".
+func ParseDockerRef(dockerRef string) (Reference, error) {
+	if transport, within, ok := splitLocalRef(dockerRef); ok {
+		return parseLocalRef(transport, within)
+	}
+
+	named, err := reference.ParseNormalizedNamed(dockerRef)
+	if err != nil {
+		return Reference{}, fmt.Errorf(
+			"invalid docker image reference [%s]: %s (expected [registry[:port]/]name[:tag][@digest])",
+			dockerRef,
+			err.Error(),
+		)
+	}
+
+	ref := Reference{
+		RegistryURL: reference.Domain(named),
+		RepoName:    reference.Path(named),
+	}
+	if ref.RegistryURL == dockerHubDomain {
+		ref.RegistryURL = DockerHubHostname
+	}
+	if ref.RegistryURL == DockerHubHostname && !strings.Contains(ref.RepoName, "/") {
+		ref.RepoName = "library/" + ref.RepoName
+	}
 
-	if hostname == DockerHubHostname && !strings.Contains(repoName, "/") {
-		repoName = "library/" + repoName
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
 	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.Digest = digested.Digest()
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
 
-	if len(tag) == 0 {
-		tag = "latest"
+// String returns the reference in the form used to run the image. Images from
+// Docker Hub are referenced without the registry, and images on the file
+// system by their transport and path.
+func (r Reference) String() string {
+	if r.IsLocal() {
+		return r.Transport + ":" + r.Path
+	}
+	name := r.RepoName
+	if r.RegistryURL != DockerHubHostname {
+		name = r.RegistryURL + "/" + name
+	}
+	if r.Tag != "" {
+		name = name + ":" + r.Tag
+	}
+	if r.Digest != "" {
+		name = name + "@" + r.Digest.String()
 	}
-	return hostname, repoName, tag
+	return name
 }
 
-// stolen from docker/docker
-// Get a repos name and returns the right reposName + tag
-// The tag can be confusing because of a port in a repository name.
-//
-//	Ex: localhost.localdomain:5000/samalba/hipache:latest
-func ParseRepositoryTag(repos string) (string, string) {
-	n := strings.LastIndex(repos, ":")
-	if n < 0 {
-		return repos, ""
+// IsLocal reports whether the image is read from the file system rather than
+// from a registry.
+func (r Reference) IsLocal() bool {
+	return r.Transport != ""
+}
+
+// imageReference returns the containers/image reference of the image.
+func (r Reference) imageReference() (types.ImageReference, error) {
+	if !r.IsLocal() {
+		return docker.ParseReference(r.transportReference())
+	}
+	transport, ok := localTransports[r.Transport]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image transport [%s]", r.Transport)
 	}
-	if tag := repos[n+1:]; !strings.Contains(tag, "/") {
-		return repos[:n], tag
+	return transport.ParseReference(r.Path)
+}
+
+// transportReference returns the reference in the format expected by the
+// containers/image docker transport, which does not support references with
+// both a tag and a digest. The digest wins as it identifies the image exactly.
+func (r Reference) transportReference() string {
+	if r.Digest != "" {
+		return fmt.Sprintf("//%s/%s@%s", r.RegistryURL, r.RepoName, r.Digest)
 	}
-	return repos, ""
+	return fmt.Sprintf("//%s/%s:%s", r.RegistryURL, r.RepoName, r.Tag)
 }
 
-func FetchMetadata(registryURL, repoName, tag string, ctx *types.SystemContext, stderr io.Writer) (*v1.ImageConfig, error) {
-	dockerRef := fmt.Sprintf("//%s/%s", registryURL, repoName+":"+tag)
-	ref, err := docker.ParseReference(dockerRef)
+// ImageMetadata is the configuration of an image along with the digest of the
+// manifest it was resolved from. Size is the total compressed size of the
+// layers, and MediaType and ConfigDigest describe the manifest of the image
+// for the requested platform.
+type ImageMetadata struct {
+	v1.ImageConfig
+	ManifestDigest digest.Digest
+	Size           int64
+	Layers         int
+	MediaType      string
+	ConfigDigest   digest.Digest
+}
+
+// FetchMetadata resolves dockerRef and returns the configuration of the image.
+// When policyContext is not nil the image must satisfy its signature policy
+// before any metadata is extracted. Failed registry requests are retried
+// according to retryPolicy and aborted when ctx is done.
+func FetchMetadata(ctx context.Context, dockerRef Reference, sys *types.SystemContext, policyContext *signature.PolicyContext, retryPolicy RetryPolicy, logger logging.EventLogger) (*ImageMetadata, error) {
+	ref, err := dockerRef.imageReference()
 	if err != nil {
 		return nil, err
 	}
@@ -88,85 +172,383 @@ func FetchMetadata(registryURL, repoName, tag string, ctx *types.SystemContext,
 		manifest.DockerV2Schema1MediaType,
 	}
 
-	var imageConfig *v1.Image
 	var imgSrc types.ImageSource
-	for i := 0; i < MAX_DOCKER_RETRIES; i++ {
-		imgSrc, err = ref.NewImageSource(context.Background(), ctx)
-		if err != nil && i < MAX_DOCKER_RETRIES-1 {
-			fmt.Fprintln(stderr, "Failed getting docker image manifest by tag:", err, " Going to retry attempt:", i+1)
-			continue
-		} else if err != nil {
-			fmt.Fprintln(stderr, "Failed getting docker image manifest by tag:", err)
-			continue
-		}
-		defer imgSrc.Close()
-		break
+	err = withRetries(ctx, retryPolicy, logging.PhaseManifest, "manifest by tag", logger, func() error {
+		var err error
+		imgSrc, err = ref.NewImageSource(ctx, sys)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	defer imgSrc.Close()
 
+	err = checkSignaturePolicy(ctx, policyContext, imgSrc)
 	if err != nil {
 		return nil, err
 	}
 
-	img, err := image.FromUnparsedImage(context.Background(), ctx, image.UnparsedInstance(imgSrc, nil))
+	rawManifest, mimeType, err := imgSrc.GetManifest(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := 0; i < MAX_DOCKER_RETRIES; i++ {
-		imageConfig, err = img.OCIConfig(context.Background())
-		if err != nil && i < MAX_DOCKER_RETRIES-1 {
-			fmt.Fprintln(stderr, "Failed getting docker image config by tag:", err, " Going to retry attempt:", i+1)
-			continue
-		} else if err != nil {
-			fmt.Fprintln(stderr, "Failed getting docker image config by tag:", err)
-			continue
-		}
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkPlatform(rawManifest, mimeType, sys)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(imgSrc, nil))
+	if err != nil {
+		return nil, err
+	}
 
-		break
+	var imageConfig *v1.Image
+	err = withRetries(ctx, retryPolicy, logging.PhaseConfig, "config by tag", logger, func() error {
+		var err error
+		imageConfig, err = img.OCIConfig(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	// registries may serve schema1 manifests with any content type, so the
+	// type is normalized the way the manifest was parsed
+	_, mediaType, err := img.Manifest(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return &imageConfig.Config, nil
+	// schema1 manifests do not record the layer sizes
+	var size int64
+	layers := img.LayerInfos()
+	for _, layer := range layers {
+		if layer.Size > 0 {
+			size += layer.Size
+		}
+	}
+
+	return &ImageMetadata{
+		ImageConfig:    imageConfig.Config,
+		ManifestDigest: manifestDigest,
+		Size:           size,
+		Layers:         len(layers),
+		MediaType:      manifest.NormalizedMIMEType(mediaType),
+		ConfigDigest:   img.ConfigInfo().Digest,
+	}, nil
 }
 
-func SaveMetadata(filename string, metadata *protocol.DockerImageMetadata) error {
-	err := os.MkdirAll(path.Dir(filename), 0755)
+// checkSignaturePolicy evaluates the signature policy against the image
+// provided by imgSrc. A nil policyContext accepts any image.
+func checkSignaturePolicy(ctx context.Context, policyContext *signature.PolicyContext, imgSrc types.ImageSource) error {
+	if policyContext == nil {
+		return nil
+	}
+
+	allowed, err := policyContext.IsRunningImageAllowed(ctx, image.UnparsedInstance(imgSrc, nil))
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrSignatureRejected, err)
 	}
+	if !allowed {
+		return ErrSignatureRejected
+	}
+	return nil
+}
 
-	executionMetadataJSON, err := json.Marshal(metadata.ExecutionMetadata)
+// CacheImage copies the manifest and blobs of the image referenced by srcRef
+// into the registry at registryAddress (host:port). It returns the reference of
+// the cached copy and the digest of the manifest that was pushed. An image
+// referenced by digest alone is cached whole, with every instance of a
+// multi-arch index, so that the cached copy has the same digest. The source
+// image must satisfy policyContext; a nil policyContext accepts any image.
+func CacheImage(ctx context.Context, srcRef Reference, srcCtx *types.SystemContext, policyContext *signature.PolicyContext, registryAddress string, destCtx *types.SystemContext, logger logging.EventLogger) (Reference, digest.Digest, error) {
+	src, err := srcRef.imageReference()
+	if err != nil {
+		return Reference{}, "", err
+	}
+
+	cachedRef := Reference{
+		RegistryURL: registryAddress,
+		RepoName:    srcRef.RepoName,
+		Tag:         srcRef.Tag,
+	}
+	if cachedRef.Tag == "" {
+		cachedRef.Digest = srcRef.Digest
+	}
+
+	dest, err := docker.ParseReference(cachedRef.transportReference())
+	if err != nil {
+		return Reference{}, "", err
+	}
+
+	if policyContext == nil {
+		acceptAnything, err := signature.NewPolicyContext(&signature.Policy{
+			Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+		})
+		if err != nil {
+			return Reference{}, "", err
+		}
+		defer acceptAnything.Destroy()
+		policyContext = acceptAnything
+	}
+
+	options := &copy.Options{
+		ReportWriter:   logger.Writer(logging.PhaseCache),
+		SourceCtx:      srcCtx,
+		DestinationCtx: destCtx,
+	}
+	if cachedRef.Digest != "" {
+		options.PreserveDigests = true
+		options.ImageListSelection = copy.CopyAllImages
+	}
+
+	copiedManifest, err := copy.Image(ctx, policyContext, dest, src, options)
+	if err != nil {
+		return Reference{}, "", err
+	}
+
+	manifestDigest, err := manifest.Digest(copiedManifest)
+	if err != nil {
+		return Reference{}, "", err
+	}
+	return cachedRef, manifestDigest, nil
+}
+
+// UnsupportedPlatformError is returned when a multi-arch image does not
+// provide a manifest for the requested platform.
+type UnsupportedPlatformError struct {
+	Requested string
+	Available []string
+}
+
+func (e *UnsupportedPlatformError) Error() string {
+	return fmt.Sprintf(
+		"no image found for platform %s; available platforms: %s",
+		e.Requested,
+		strings.Join(e.Available, ", "),
+	)
+}
+
+// ImageTooLargeError is returned when the layers of an image are larger than
+// the allowed maximum.
+type ImageTooLargeError struct {
+	Size    int64
+	MaxSize int64
+}
+
+func (e *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image size of %d bytes exceeds the maximum of %d bytes", e.Size, e.MaxSize)
+}
+
+// TooManyLayersError is returned when an image has more layers than allowed.
+type TooManyLayersError struct {
+	Layers    int
+	MaxLayers int
+}
+
+func (e *TooManyLayersError) Error() string {
+	return fmt.Sprintf("image has %d layers, more than the maximum of %d", e.Layers, e.MaxLayers)
+}
+
+// CheckImageLimits compares the layer descriptors recorded in metadata with
+// the maximum size and number of layers, so that oversized images are rejected
+// without downloading any layer. A maximum of zero is no limit.
+func CheckImageLimits(metadata *ImageMetadata, maxSize int64, maxLayers int) error {
+	if maxLayers > 0 && metadata.Layers > maxLayers {
+		return &TooManyLayersError{Layers: metadata.Layers, MaxLayers: maxLayers}
+	}
+	if maxSize > 0 && metadata.Size > maxSize {
+		return &ImageTooLargeError{Size: metadata.Size, MaxSize: maxSize}
+	}
+	return nil
+}
+
+// ParsePlatform parses a platform in os/arch[/variant] format. An empty string
+// yields an empty platform, which selects the platform the builder runs on.
+func ParsePlatform(platform string) (v1.Platform, error) {
+	if platform == "" {
+		return v1.Platform{}, nil
+	}
+
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v1.Platform{}, fmt.Errorf("invalid platform [%s]: expected os/arch[/variant]", platform)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return v1.Platform{}, fmt.Errorf("invalid platform [%s]: expected os/arch[/variant]", platform)
+		}
+	}
+
+	parsed := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		parsed.Variant = parts[2]
+	}
+	return parsed, nil
+}
+
+// checkPlatform makes sure that a manifest list or image index contains an
+// image for the platform requested in sys, so that staging fails with the
+// list of available platforms instead of an opaque error.
+func checkPlatform(rawManifest []byte, mimeType string, sys *types.SystemContext) error {
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil
+	}
+
+	list, err := manifest.ListFromBlob(rawManifest, mimeType)
 	if err != nil {
 		return err
 	}
+	if _, err := list.ChooseInstance(sys); err == nil {
+		return nil
+	}
 
-	resultFile, err := os.Create(filename)
+	available, err := listPlatforms(rawManifest, mimeType)
 	if err != nil {
 		return err
 	}
+	return &UnsupportedPlatformError{
+		Requested: requestedPlatform(sys),
+		Available: available,
+	}
+}
 
-	defer resultFile.Close()
+func listPlatforms(rawManifest []byte, mimeType string) ([]string, error) {
+	platforms := []string{}
 
-	startCommand := strings.Join(metadata.ExecutionMetadata.Cmd, " ")
-	if len(metadata.ExecutionMetadata.Entrypoint) > 0 {
-		startCommand = strings.Join([]string{strings.Join(metadata.ExecutionMetadata.Entrypoint, " "), startCommand}, " ")
+	if manifest.NormalizedMIMEType(mimeType) == manifest.DockerV2ListMediaType {
+		list, err := manifest.Schema2ListFromManifest(rawManifest)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range list.Manifests {
+			platforms = append(platforms, formatPlatform(m.Platform.OS, m.Platform.Architecture, m.Platform.Variant))
+		}
+		return platforms, nil
 	}
 
-	err = json.NewEncoder(resultFile).Encode(dockerapplifecycle.NewStagingResult(
-		dockerapplifecycle.ProcessTypes{
-			"web": startCommand,
-		},
+	index, err := manifest.OCI1IndexFromManifest(rawManifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range index.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		platforms = append(platforms, formatPlatform(m.Platform.OS, m.Platform.Architecture, m.Platform.Variant))
+	}
+	return platforms, nil
+}
+
+func requestedPlatform(sys *types.SystemContext) string {
+	osName, arch, variant := runtime.GOOS, runtime.GOARCH, ""
+	if sys != nil {
+		if sys.OSChoice != "" {
+			osName = sys.OSChoice
+		}
+		if sys.ArchitectureChoice != "" {
+			arch = sys.ArchitectureChoice
+		}
+		variant = sys.VariantChoice
+	}
+	return formatPlatform(osName, arch, variant)
+}
+
+func formatPlatform(osName, arch, variant string) string {
+	if variant == "" {
+		return osName + "/" + arch
+	}
+	return osName + "/" + arch + "/" + variant
+}
+
+// NewStagingResult builds the staging result from the image metadata. The web
+// process type runs the entrypoint and command of the image unless metadata
+// declares its own web process.
+func NewStagingResult(metadata *protocol.DockerImageMetadata) (dockerapplifecycle.StagingResult, error) {
+	executionMetadataJSON, err := json.Marshal(metadata.ExecutionMetadata)
+	if err != nil {
+		return dockerapplifecycle.StagingResult{}, err
+	}
+
+	startCommand := ShellQuote(append(append([]string{}, metadata.ExecutionMetadata.Entrypoint...), metadata.ExecutionMetadata.Cmd...))
+
+	processTypes := dockerapplifecycle.ProcessTypes{
+		webProcessType: startCommand,
+	}
+	for name, command := range metadata.ProcessTypes {
+		processTypes[name] = command
+	}
+
+	return dockerapplifecycle.NewStagingResult(
+		processTypes,
 		dockerapplifecycle.LifecycleMetadata{
-			DockerImage: metadata.DockerImage,
+			DockerImage:             metadata.DockerImage,
+			DockerImageDigest:       metadata.DockerImageDigest,
+			DockerImageSize:         metadata.DockerImageSize,
+			DockerImageLayers:       metadata.DockerImageLayers,
+			DockerImageMediaType:    metadata.DockerImageMediaType,
+			DockerImageConfigDigest: metadata.DockerImageConfigDigest,
 		},
 		string(executionMetadataJSON),
-	))
+	), nil
+}
+
+// SaveMetadata writes the staging result of metadata to filename. The result
+// is written to a temporary file first and renamed into place, so that readers
+// never see a partially written file.
+func SaveMetadata(filename string, metadata *protocol.DockerImageMetadata) error {
+	result, err := NewStagingResult(metadata)
 	if err != nil {
 		return err
 	}
+	return SaveStagingResult(filename, result)
+}
 
-	return nil
+// SaveStagingResult writes result to filename in the same way as SaveMetadata.
+func SaveStagingResult(filename string, result dockerapplifecycle.StagingResult) error {
+	return writeJSON(filename, result)
+}
+
+// SaveFailure writes the failure document of a failed staging to filename,
+// in the same way as SaveMetadata.
+func SaveFailure(filename string, failure dockerapplifecycle.StagingFailure) error {
+	return writeJSON(filename, failure)
+}
+
+func writeJSON(filename string, value interface{}) error {
+	err := os.MkdirAll(path.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(path.Dir(filename), "."+path.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	err = json.NewEncoder(file).Encode(value)
+	if err != nil {
+		return err
+	}
+
+	err = file.Chmod(0644)
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
 }
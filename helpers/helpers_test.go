@@ -1,28 +1,54 @@
 package helpers_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/dockerapplifecycle"
 	"code.cloudfoundry.org/dockerapplifecycle/helpers"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
 	"code.cloudfoundry.org/dockerapplifecycle/protocol"
+	"code.cloudfoundry.org/dockerapplifecycle/testhelpers"
 	"code.cloudfoundry.org/tlsconfig"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/directory"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
 	"github.com/containers/image/v5/manifest"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/ghttp"
 	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+var logger = logging.New(GinkgoWriter, logging.TextFormat)
+
+// retryPolicy keeps the retry specs fast.
+var retryPolicy = helpers.RetryPolicy{
+	MaxAttempts:    helpers.MAX_DOCKER_RETRIES,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     10 * time.Millisecond,
+}
+
 type serverResponseConfig struct {
 	ImageConfig            v1.ImageConfig
 	ImageTag               string
@@ -174,7 +200,7 @@ var _ = Describe("Builder helpers", func() {
 		)
 	}
 
-	v2Schema2Manifest := func(serverConfig serverResponseConfig) {
+	v2Schema2Manifest := func(serverConfig serverResponseConfig) digest.Digest {
 		if serverConfig.WithTokenAuthorization {
 			authenticateHeader := http.Header{}
 			authenticateHeader.Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token"`, server.Addr()))
@@ -223,6 +249,10 @@ var _ = Describe("Builder helpers", func() {
 				Size:      int64(len(configBytes)),
 				Digest:    configDigest,
 			},
+			LayersDescriptors: []manifest.Schema2Descriptor{
+				{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: 1000, Digest: digest.FromString("layer-1")},
+				{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: 234, Digest: digest.FromString("layer-2")},
+			},
 		}
 		manifestBytes, err := json.Marshal(m)
 		Expect(err).ToNot(HaveOccurred())
@@ -306,6 +336,66 @@ var _ = Describe("Builder helpers", func() {
 		server.AppendHandlers(
 			ghttp.CombineHandlers(verifyRequests...),
 		)
+
+		return digest.FromBytes(manifestBytes)
+	}
+
+	respondWithContent := func(mediaType string, content []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", mediaType)
+			w.Write(content)
+		}
+	}
+
+	multiArchImage := func(imageTag string, platforms ...v1.Platform) digest.Digest {
+		server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(200, ""))
+
+		descriptors := []v1.Descriptor{}
+		for _, platform := range platforms {
+			configBytes, err := json.Marshal(v1.Image{
+				Platform: platform,
+				Config:   v1.ImageConfig{Cmd: []string{"dockerapp-" + platform.Architecture}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			configDigest := digest.FromBytes(configBytes)
+
+			manifestBytes, err := json.Marshal(v1.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: v1.MediaTypeImageManifest,
+				Config: v1.Descriptor{
+					MediaType: v1.MediaTypeImageConfig,
+					Digest:    configDigest,
+					Size:      int64(len(configBytes)),
+				},
+				Layers: []v1.Descriptor{},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			manifestDigest := digest.FromBytes(manifestBytes)
+
+			server.RouteToHandler("GET", "/v2/some_user/some_repo/manifests/"+manifestDigest.String(), respondWithContent(v1.MediaTypeImageManifest, manifestBytes))
+			server.RouteToHandler("GET", "/v2/some_user/some_repo/blobs/"+configDigest.String(), respondWithContent("application/octet-stream", configBytes))
+
+			descriptorPlatform := platform
+			descriptors = append(descriptors, v1.Descriptor{
+				MediaType: v1.MediaTypeImageManifest,
+				Digest:    manifestDigest,
+				Size:      int64(len(manifestBytes)),
+				Platform:  &descriptorPlatform,
+			})
+		}
+
+		indexBytes, err := json.Marshal(v1.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageIndex,
+			Manifests: descriptors,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		indexDigest := digest.FromBytes(indexBytes)
+		server.RouteToHandler("GET", "/v2/some_user/some_repo/manifests/"+imageTag, respondWithContent(v1.MediaTypeImageIndex, indexBytes))
+		server.RouteToHandler("GET", "/v2/some_user/some_repo/manifests/"+indexDigest.String(), respondWithContent(v1.MediaTypeImageIndex, indexBytes))
+
+		return indexDigest
 	}
 
 	resultJSON := func(filename string) []byte {
@@ -316,39 +406,475 @@ var _ = Describe("Builder helpers", func() {
 	}
 
 	Describe("ParseDockerRef", func() {
+		const imageDigest = "sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"
+
 		Context("when the repo image is from dockerhub", func() {
 			It("prepends 'library/' to the repo Name if there is no '/' character", func() {
-				repositoryURL, repoName, _ := helpers.ParseDockerRef("redis")
-				Expect(repositoryURL).To(Equal("registry-1.docker.io"))
-				Expect(repoName).To(Equal("library/redis"))
+				ref, err := helpers.ParseDockerRef("redis")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.RegistryURL).To(Equal("registry-1.docker.io"))
+				Expect(ref.RepoName).To(Equal("library/redis"))
 			})
 
 			It("does not prepends 'library/' to the repo Name if there is a '/' ", func() {
-				repositoryURL, repoName, _ := helpers.ParseDockerRef("b/c")
-				Expect(repositoryURL).To(Equal("registry-1.docker.io"))
-				Expect(repoName).To(Equal("b/c"))
+				ref, err := helpers.ParseDockerRef("b/c")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.RegistryURL).To(Equal("registry-1.docker.io"))
+				Expect(ref.RepoName).To(Equal("b/c"))
+			})
+
+			It("maps the docker.io domains to the registry hostname", func() {
+				for _, dockerRef := range []string{"docker.io/b/c", "index.docker.io/b/c"} {
+					ref, err := helpers.ParseDockerRef(dockerRef)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ref.RegistryURL).To(Equal("registry-1.docker.io"), dockerRef)
+					Expect(ref.RepoName).To(Equal("b/c"), dockerRef)
+				}
 			})
 		})
 
 		Context("When the registryURL is not dockerhub", func() {
 			It("does not add a '/' character to a single repo name", func() {
-				repositoryURL, repoName, _ := helpers.ParseDockerRef("foobar:5123/baz")
-				Expect(repositoryURL).To(Equal("foobar:5123"))
-				Expect(repoName).To(Equal("baz"))
+				ref, err := helpers.ParseDockerRef("foobar:5123/baz")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.RegistryURL).To(Equal("foobar:5123"))
+				Expect(ref.RepoName).To(Equal("baz"))
 			})
 		})
 
 		Context("Parsing tags", func() {
 			It("should parse tags based off the last colon", func() {
-				_, _, tag := helpers.ParseDockerRef("baz/bot:test")
-				Expect(tag).To(Equal("test"))
+				ref, err := helpers.ParseDockerRef("baz/bot:test")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.Tag).To(Equal("test"))
+			})
+
+			It("should not mistake a registry port for a tag", func() {
+				ref, err := helpers.ParseDockerRef("localhost.localdomain:5000/samalba/hipache")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.RegistryURL).To(Equal("localhost.localdomain:5000"))
+				Expect(ref.RepoName).To(Equal("samalba/hipache"))
+				Expect(ref.Tag).To(Equal("latest"))
 			})
 
 			It("should default the tag to latest", func() {
-				_, _, tag := helpers.ParseDockerRef("redis")
-				Expect(tag).To(Equal("latest"))
+				ref, err := helpers.ParseDockerRef("redis")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.Tag).To(Equal("latest"))
+			})
+		})
+
+		Context("Parsing digests", func() {
+			It("should parse a name@digest reference", func() {
+				ref, err := helpers.ParseDockerRef("ubuntu@" + imageDigest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref).To(Equal(helpers.Reference{
+					RegistryURL: "registry-1.docker.io",
+					RepoName:    "library/ubuntu",
+					Digest:      imageDigest,
+				}))
+			})
+
+			It("should parse a name:tag@digest reference", func() {
+				ref, err := helpers.ParseDockerRef("foobar:5123/baz:1.0@" + imageDigest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref).To(Equal(helpers.Reference{
+					RegistryURL: "foobar:5123",
+					RepoName:    "baz",
+					Tag:         "1.0",
+					Digest:      imageDigest,
+				}))
+			})
+		})
+
+		Context("with an invalid reference", func() {
+			It("should error with a description of the problem", func() {
+				_, err := helpers.ParseDockerRef("Ubuntu")
+				Expect(err).To(MatchError(ContainSubstring("invalid docker image reference [Ubuntu]: invalid reference format: repository name must be lowercase")))
+			})
+
+			It("should error on a malformed digest", func() {
+				_, err := helpers.ParseDockerRef("ubuntu@sha256:abc")
+				Expect(err).To(MatchError(ContainSubstring("invalid docker image reference [ubuntu@sha256:abc]")))
+			})
+
+			It("should error on an empty tag", func() {
+				_, err := helpers.ParseDockerRef("ubuntu:")
+				Expect(err).To(MatchError(ContainSubstring("expected [registry[:port]/]name[:tag][@digest]")))
+			})
+		})
+
+		Context("with an image on the file system", func() {
+			var imagesDir string
+
+			BeforeEach(func() {
+				imagesDir = GinkgoT().TempDir()
+			})
+
+			It("should parse an OCI layout reference", func() {
+				ref, err := helpers.ParseDockerRef("oci:" + imagesDir + "/app:1.0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref).To(Equal(helpers.Reference{
+					Transport: "oci",
+					Path:      imagesDir + "/app:1.0",
+					RepoName:  "app",
+					Tag:       "1.0",
+				}))
+				Expect(ref.IsLocal()).To(BeTrue())
+			})
+
+			It("should derive the repository name from the file name", func() {
+				ref, err := helpers.ParseDockerRef("oci-archive:./My_App.tar")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.RepoName).To(Equal("my-app"))
+				Expect(ref.Tag).To(Equal("latest"))
+			})
+
+			It("should use the name recorded in a docker archive reference", func() {
+				ref, err := helpers.ParseDockerRef("docker-archive:/images/app.tar:example.com/team/app:2.0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.RepoName).To(Equal("team/app"))
+				Expect(ref.Tag).To(Equal("2.0"))
+			})
+
+			It("should parse a directory reference", func() {
+				ref, err := helpers.ParseDockerRef("dir:" + imagesDir + "/app")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.Transport).To(Equal("dir"))
+				Expect(ref.Path).To(Equal(imagesDir + "/app"))
+				Expect(ref.RepoName).To(Equal("app"))
+			})
+
+			It("should keep treating names without a path as docker references", func() {
+				ref, err := helpers.ParseDockerRef("dir:latest")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ref.IsLocal()).To(BeFalse())
+				Expect(ref.RepoName).To(Equal("library/dir"))
+			})
+
+			It("should error on an invalid transport reference", func() {
+				_, err := helpers.ParseDockerRef("docker-archive:/images/app.tar:Invalid")
+				Expect(err).To(MatchError(ContainSubstring("invalid image reference [docker-archive:/images/app.tar:Invalid]")))
+			})
+
+			It("should error when the parent directory does not exist", func() {
+				_, err := helpers.ParseDockerRef("oci:" + imagesDir + "/missing/app")
+				Expect(err).To(MatchError(ContainSubstring("no such file or directory")))
+			})
+		})
+	})
+
+	Describe("Reference", func() {
+		It("omits the docker hub registry", func() {
+			ref := helpers.Reference{RegistryURL: "registry-1.docker.io", RepoName: "library/redis", Tag: "latest"}
+			Expect(ref.String()).To(Equal("library/redis:latest"))
+		})
+
+		It("includes other registries, tags and digests", func() {
+			ref := helpers.Reference{RegistryURL: "foobar:5123", RepoName: "baz", Tag: "1.0", Digest: "sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"}
+			Expect(ref.String()).To(Equal("foobar:5123/baz:1.0@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"))
+		})
+
+		It("uses the transport and path of images on the file system", func() {
+			ref := helpers.Reference{Transport: "oci", Path: "/images/app:1.0", RepoName: "app", Tag: "1.0"}
+			Expect(ref.String()).To(Equal("oci:/images/app:1.0"))
+		})
+	})
+
+	Describe("ImageProcessTypes", func() {
+		var config v1.ImageConfig
+
+		BeforeEach(func() {
+			config = v1.ImageConfig{Cmd: []string{"bin/web"}}
+		})
+
+		It("should return no process types without labels", func() {
+			Expect(helpers.ImageProcessTypes(config)).To(BeEmpty())
+		})
+
+		It("should read the process types label and the per-process labels", func() {
+			config.Labels = map[string]string{
+				helpers.ProcessTypesLabel:                `{"worker":"bin/worker","scheduler":"bin/old-scheduler"}`,
+				helpers.ProcessLabelPrefix + "scheduler": "bin/scheduler",
+				"org.opencontainers.image.title":         "some-app",
+			}
+			Expect(helpers.ImageProcessTypes(config)).To(Equal(dockerapplifecycle.ProcessTypes{
+				"worker":    "bin/worker",
+				"scheduler": "bin/scheduler",
+			}))
+		})
+
+		It("should reject an invalid process types label", func() {
+			config.Labels = map[string]string{helpers.ProcessTypesLabel: `["worker"]`}
+			_, err := helpers.ImageProcessTypes(config)
+			Expect(err).To(MatchError(ContainSubstring("invalid org.cloudfoundry.process-types label")))
+		})
+
+		It("should reject invalid process type names", func() {
+			config.Labels = map[string]string{helpers.ProcessLabelPrefix + "my worker": "bin/worker"}
+			_, err := helpers.ImageProcessTypes(config)
+			Expect(err).To(MatchError("invalid process type name [my worker]"))
+		})
+
+		It("should reject empty start commands", func() {
+			config.Labels = map[string]string{helpers.ProcessLabelPrefix + "worker": " "}
+			_, err := helpers.ImageProcessTypes(config)
+			Expect(err).To(MatchError("empty start command for process type [worker]"))
+		})
+
+		Context("when the image has no entrypoint or command", func() {
+			BeforeEach(func() {
+				config.Cmd = nil
+			})
+
+			It("should require a web process in the labels", func() {
+				config.Labels = map[string]string{helpers.ProcessLabelPrefix + "worker": "bin/worker"}
+				_, err := helpers.ImageProcessTypes(config)
+				Expect(err).To(MatchError(ContainSubstring("no web process type")))
+			})
+
+			It("should accept a web process from the labels", func() {
+				config.Labels = map[string]string{helpers.ProcessLabelPrefix + "web": "bin/web"}
+				Expect(helpers.ImageProcessTypes(config)).To(HaveKeyWithValue("web", "bin/web"))
+			})
+		})
+	})
+
+	Describe("AdmissionPolicy", func() {
+		var policy *helpers.AdmissionPolicy
+
+		check := func(dockerRef string) error {
+			ref, err := helpers.ParseDockerRef(dockerRef)
+			Expect(err).NotTo(HaveOccurred())
+			return policy.Check(ref)
+		}
+
+		BeforeEach(func() {
+			policy = &helpers.AdmissionPolicy{}
+		})
+
+		It("should admit any image by default", func() {
+			Expect(check("ubuntu")).To(Succeed())
+		})
+
+		Context("with allow and deny rules", func() {
+			BeforeEach(func() {
+				policy.Allow = []string{"registry.example.com/team/**", "docker.io/library/*"}
+				policy.Deny = []string{"registry.example.com/team/legacy-*"}
+			})
+
+			It("should admit allowed images", func() {
+				Expect(check("registry.example.com/team/app:1.0")).To(Succeed())
+				Expect(check("registry.example.com/team/group/app:1.0")).To(Succeed())
+				Expect(check("ubuntu:22.04")).To(Succeed())
+				Expect(check("registry-1.docker.io/library/ubuntu:22.04")).To(Succeed())
+			})
+
+			It("should reject images that are not allowed", func() {
+				err := check("registry.example.com/other/app:1.0")
+				Expect(err).To(MatchError("image [registry.example.com/other/app:1.0] violates the admission policy: not in the allowed registries and repositories"))
+
+				Expect(check("someuser/app")).NotTo(Succeed())
+			})
+
+			It("should let deny rules win", func() {
+				err := check("registry.example.com/team/legacy-app:1.0")
+				Expect(err).To(MatchError(ContainSubstring("denied by [registry.example.com/team/legacy-*]")))
+
+				var violation *helpers.PolicyViolationError
+				Expect(errors.As(err, &violation)).To(BeTrue())
+			})
+
+			It("should match images on the file system by their reference", func() {
+				ref := helpers.Reference{Transport: "oci", Path: "/images/app:1.0", RepoName: "app", Tag: "1.0"}
+				Expect(policy.Check(ref)).To(MatchError(ContainSubstring("not in the allowed registries and repositories")))
+
+				policy.Allow = append(policy.Allow, "oci:/images/**")
+				Expect(policy.Check(ref)).To(Succeed())
 			})
 		})
+
+		Context("when digests are required", func() {
+			BeforeEach(func() {
+				policy.RequireDigest = true
+			})
+
+			It("should reject references without a digest", func() {
+				Expect(check("ubuntu:22.04")).To(MatchError(ContainSubstring("images must be referenced by digest")))
+				Expect(check("ubuntu@sha256:7cc0576c7c0ec2384de5cbf245f41567e922aab1b075f3e8ad565f508032df17")).To(Succeed())
+			})
+		})
+
+		Context("when the latest tag is forbidden", func() {
+			BeforeEach(func() {
+				policy.ForbidLatestTag = true
+			})
+
+			It("should reject explicit and implicit latest tags", func() {
+				Expect(check("ubuntu:latest")).To(MatchError(ContainSubstring("the latest tag is not allowed")))
+				Expect(check("ubuntu")).To(MatchError(ContainSubstring("the latest tag is not allowed")))
+				Expect(check("ubuntu:22.04")).To(Succeed())
+				Expect(check("ubuntu:latest@sha256:7cc0576c7c0ec2384de5cbf245f41567e922aab1b075f3e8ad565f508032df17")).To(Succeed())
+			})
+		})
+	})
+
+	Describe("LoadAdmissionPolicy", func() {
+		var policyFile string
+
+		BeforeEach(func() {
+			dir, err := os.MkdirTemp("", "admission")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			policyFile = filepath.Join(dir, "admission.json")
+		})
+
+		It("should load the rules", func() {
+			Expect(os.WriteFile(policyFile, []byte(`{"allow":["registry.example.com/**"],"deny":["*/*"],"require_digest":true,"forbid_latest_tag":true}`), 0644)).To(Succeed())
+
+			policy, err := helpers.LoadAdmissionPolicy(policyFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*policy).To(Equal(helpers.AdmissionPolicy{
+				Allow:           []string{"registry.example.com/**"},
+				Deny:            []string{"*/*"},
+				RequireDigest:   true,
+				ForbidLatestTag: true,
+			}))
+		})
+
+		It("should reject invalid JSON", func() {
+			Expect(os.WriteFile(policyFile, []byte(`{"allow":`), 0644)).To(Succeed())
+
+			_, err := helpers.LoadAdmissionPolicy(policyFile)
+			Expect(err).To(MatchError(ContainSubstring("invalid admission policy [" + policyFile + "]")))
+		})
+
+		It("should reject misspelt rules", func() {
+			Expect(os.WriteFile(policyFile, []byte(`{"deny":["*/*"],"requireDigest":true}`), 0644)).To(Succeed())
+
+			_, err := helpers.LoadAdmissionPolicy(policyFile)
+			Expect(err).To(MatchError(`invalid admission policy [` + policyFile + `]: json: unknown field "requireDigest"`))
+		})
+
+		It("should reject data after the policy", func() {
+			Expect(os.WriteFile(policyFile, []byte(`{"deny":["*/*"]} {"allow":["**"]}`), 0644)).To(Succeed())
+
+			_, err := helpers.LoadAdmissionPolicy(policyFile)
+			Expect(err).To(MatchError(ContainSubstring("unexpected data after the policy")))
+		})
+	})
+
+	Describe("ShellQuote", func() {
+		It("should leave plain arguments unquoted", func() {
+			Expect(helpers.ShellQuote([]string{"/dockerapp", "-t", "--port=8080", "a,b:c@d%e+f"})).To(Equal("/dockerapp -t --port=8080 a,b:c@d%e+f"))
+		})
+
+		It("should single-quote arguments the shell would interpret", func() {
+			Expect(helpers.ShellQuote([]string{"echo", "two words", "it's", "$HOME", ""})).To(Equal(`echo 'two words' 'it'\''s' '$HOME' ''`))
+		})
+
+		It("should quote a first word that looks like a variable assignment", func() {
+			Expect(helpers.ShellQuote([]string{"FOO=bar", "--port=8080"})).To(Equal("'FOO=bar' --port=8080"))
+		})
+
+		It("should quote a first word that is a reserved word", func() {
+			Expect(helpers.ShellQuote([]string{"if", "then"})).To(Equal("'if' then"))
+			Expect(helpers.ShellQuote([]string{"time", "-p"})).To(Equal("'time' -p"))
+			Expect(helpers.ShellQuote([]string{"!", "{"})).To(Equal("'!' '{'"))
+		})
+
+		DescribeTable("running the command through sh -c yields the original argv",
+			func(argv ...string) {
+				// all the commands print the arguments they receive, each
+				// terminated by a NUL byte
+				binDir := GinkgoT().TempDir()
+				script := []byte("#!/bin/sh\nprintf '%s\\000' \"$@\"\n")
+				Expect(os.WriteFile(filepath.Join(binDir, "print-args"), script, 0755)).To(Succeed())
+				for _, name := range []string{"FOO=bar", "if", "while", "!", "{"} {
+					Expect(os.WriteFile(filepath.Join(binDir, name), script, 0755)).To(Succeed())
+				}
+
+				cmd := exec.Command("/bin/sh", "-c", helpers.ShellQuote(argv))
+				cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+				output, err := cmd.Output()
+				Expect(err).NotTo(HaveOccurred())
+
+				received := strings.Split(string(output), "\x00")
+				Expect(received[:len(received)-1]).To(Equal(argv[1:]))
+			},
+			Entry("plain arguments", "print-args", "-bazbot", "-foobar"),
+			Entry("spaces and tabs", "print-args", "two words", "tab\tseparated", "  padded  "),
+			Entry("quotes", "print-args", "it's", `"double"`, `'single'`, `mixed "'"`),
+			Entry("expansions", "print-args", "$HOME", "${PATH}", "`id`", "$(id)", "~", "*", "?", "[a-z]"),
+			Entry("operators", "print-args", "a;b", "a&&b", "a|b", "a>b", "<a", "(a)", "{a,b}", "#comment"),
+			Entry("backslashes and newlines", "print-args", `back\slash`, "new\nline", `trailing\`),
+			Entry("empty arguments", "print-args", "", "between", ""),
+			Entry("a command named like a variable assignment", "FOO=bar", "FOO=baz", "arg"),
+			Entry("a command named if", "if", "then", "fi"),
+			Entry("a command named while", "while", "do"),
+			Entry("a command named !", "!", "arg"),
+			Entry("a command named {", "{", "}"),
+		)
+	})
+
+	Describe("CheckImageLimits", func() {
+		var metadata *helpers.ImageMetadata
+
+		BeforeEach(func() {
+			metadata = &helpers.ImageMetadata{Size: 1000, Layers: 3}
+		})
+
+		It("should accept images within the limits", func() {
+			Expect(helpers.CheckImageLimits(metadata, 1000, 3)).To(Succeed())
+		})
+
+		It("should not limit images without maximums", func() {
+			Expect(helpers.CheckImageLimits(metadata, 0, 0)).To(Succeed())
+		})
+
+		It("should reject images that are too large", func() {
+			err := helpers.CheckImageLimits(metadata, 999, 0)
+			Expect(err).To(MatchError("image size of 1000 bytes exceeds the maximum of 999 bytes"))
+
+			var tooLarge *helpers.ImageTooLargeError
+			Expect(errors.As(err, &tooLarge)).To(BeTrue())
+			Expect(tooLarge.Size).To(Equal(int64(1000)))
+		})
+
+		It("should reject images with too many layers", func() {
+			err := helpers.CheckImageLimits(metadata, 0, 2)
+			Expect(err).To(MatchError("image has 3 layers, more than the maximum of 2"))
+
+			var tooManyLayers *helpers.TooManyLayersError
+			Expect(errors.As(err, &tooManyLayers)).To(BeTrue())
+		})
+	})
+
+	Describe("ParsePlatform", func() {
+		It("parses os and architecture", func() {
+			platform, err := helpers.ParsePlatform("linux/amd64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(platform).To(Equal(v1.Platform{OS: "linux", Architecture: "amd64"}))
+		})
+
+		It("parses an optional variant", func() {
+			platform, err := helpers.ParsePlatform("linux/arm/v7")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(platform).To(Equal(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+		})
+
+		It("returns an empty platform for an empty string", func() {
+			platform, err := helpers.ParsePlatform("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(platform).To(Equal(v1.Platform{}))
+		})
+
+		It("errors on malformed platforms", func() {
+			for _, platform := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/extra"} {
+				_, err := helpers.ParsePlatform(platform)
+				Expect(err).To(MatchError(ContainSubstring("expected os/arch[/variant]")), platform)
+			}
+		})
 	})
 
 	Describe("FetchMetadata", func() {
@@ -357,6 +883,7 @@ var _ = Describe("Builder helpers", func() {
 		var tag string
 		var insecureRegistries []string
 		var ctx *types.SystemContext
+		var dockerRef helpers.Reference
 
 		BeforeEach(func() {
 			server = ghttp.NewUnstartedServer()
@@ -370,6 +897,8 @@ var _ = Describe("Builder helpers", func() {
 		})
 
 		JustBeforeEach(func() {
+			dockerRef = helpers.Reference{RegistryURL: registryURL, RepoName: repoName, Tag: tag}
+
 			fixturesPath := "fixtures"
 			tlsCA := filepath.Join(fixturesPath, "testCA.crt")
 			tlsCert := filepath.Join(fixturesPath, "localhost.cert")
@@ -408,7 +937,7 @@ var _ = Describe("Builder helpers", func() {
 			})
 
 			It("should error", func() {
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -420,7 +949,7 @@ var _ = Describe("Builder helpers", func() {
 			})
 
 			It("should error", func() {
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -432,11 +961,27 @@ var _ = Describe("Builder helpers", func() {
 			})
 
 			It("should error", func() {
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(err).To(HaveOccurred())
 			})
 		})
 
+		Context("when the context is cancelled", func() {
+			BeforeEach(func() {
+				server.AllowUnhandledRequests = true
+			})
+
+			It("should abort without retrying", func() {
+				cancelledCtx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				stderr := gbytes.NewBuffer()
+				_, err := helpers.FetchMetadata(cancelledCtx, dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(stderr).NotTo(gbytes.Say("Going to retry attempt"))
+			})
+		})
+
 		Context("with a valid repository reference", func() {
 			Context("with manifest schema 1", func() {
 				BeforeEach(func() {
@@ -444,12 +989,12 @@ var _ = Describe("Builder helpers", func() {
 				})
 
 				It("should not error", func() {
-					_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(err).NotTo(HaveOccurred())
 				})
 
 				It("should return the top-most image layer metadata", func() {
-					imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(imgConfig).NotTo(BeNil())
 					Expect(imgConfig.Cmd).NotTo(BeNil())
 					Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
@@ -457,20 +1002,28 @@ var _ = Describe("Builder helpers", func() {
 			})
 
 			Context("with manifest schema 2", func() {
+				var manifestDigest digest.Digest
+
 				BeforeEach(func() {
-					v2Schema2Manifest(serverResponseConfig{
+					manifestDigest = v2Schema2Manifest(serverResponseConfig{
 						ImageConfig: v1.ImageConfig{Cmd: []string{"dockerapp"}},
 						ImageTag:    "latest",
 					})
 				})
 
+				It("should return the manifest digest", func() {
+					imgMetadata, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(imgMetadata.ManifestDigest).To(Equal(manifestDigest))
+				})
+
 				It("should not error", func() {
-					_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(err).NotTo(HaveOccurred())
 				})
 
 				It("should return the top-most image layer metadata", func() {
-					imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(imgConfig).NotTo(BeNil())
 					Expect(imgConfig.Cmd).NotTo(BeNil())
 					Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
@@ -478,64 +1031,281 @@ var _ = Describe("Builder helpers", func() {
 			})
 		})
 
-		Context("when the network connection is slow getting the image manifest", func() {
-			BeforeEach(func() {
-				v2Schema2Manifest(serverResponseConfig{
-					ImageConfig:           v1.ImageConfig{},
-					ImageTag:              tag,
-					WithSlowImageManifest: true,
-				})
-			})
+		Context("with a signature policy", func() {
+			var policy *signature.Policy
 
-			It("should retry 3 times", func() {
-				stderr := gbytes.NewBuffer()
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, stderr)
+			fetchWithPolicy := func() (*helpers.ImageMetadata, error) {
+				policyContext, err := signature.NewPolicyContext(policy)
 				Expect(err).NotTo(HaveOccurred())
+				defer policyContext.Destroy()
 
-				Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .* retry attempt: 1`))
-				Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .* retry attempt: 2`))
-				Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .* retry attempt: 3`))
-			})
-		})
+				return helpers.FetchMetadata(context.Background(), dockerRef, ctx, policyContext, retryPolicy, logger)
+			}
 
-		Context("when the network connection is slow getting the image config", func() {
 			BeforeEach(func() {
+				server.AllowUnhandledRequests = true
 				v2Schema2Manifest(serverResponseConfig{
-					ImageConfig:         v1.ImageConfig{},
-					ImageTag:            tag,
-					WithSlowImageConfig: true,
+					ImageConfig: v1.ImageConfig{Cmd: []string{"dockerapp"}},
+					ImageTag:    "latest",
 				})
 			})
 
-			It("should retry 3 times", func() {
-				stderr := gbytes.NewBuffer()
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, stderr)
-				Expect(err).NotTo(HaveOccurred())
+			Context("that accepts the image", func() {
+				BeforeEach(func() {
+					policy = &signature.Policy{
+						Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+					}
+				})
 
-				Expect(stderr).To(gbytes.Say(`Failed getting docker image config by tag: .* retry attempt: 1`))
-				Expect(stderr).To(gbytes.Say(`Failed getting docker image config by tag: .* retry attempt: 2`))
-				Expect(stderr).To(gbytes.Say(`Failed getting docker image config by tag: .* retry attempt: 3`))
+				It("should return the image metadata", func() {
+					imgConfig, err := fetchWithPolicy()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
+				})
 			})
-		})
 
-		Context("with a valid repository:tag reference", func() {
-			BeforeEach(func() {
-				v2Schema2Manifest(serverResponseConfig{
-					ImageConfig: v1.ImageConfig{Cmd: []string{"dockerapp"}},
-					ImageTag:    tag,
+			Context("that rejects the registry", func() {
+				BeforeEach(func() {
+					policy = &signature.Policy{
+						Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+						Transports: map[string]signature.PolicyTransportScopes{
+							"docker": {
+								registryURL: signature.PolicyRequirements{signature.NewPRReject()},
+							},
+						},
+					}
+				})
+
+				It("should error with the rejected requirement", func() {
+					_, err := fetchWithPolicy()
+					Expect(err).To(MatchError(ContainSubstring("image rejected by signature policy: Running image docker://" + registryURL + "/some_user/some_repo:latest is rejected by policy.")))
+					Expect(err).To(MatchError(helpers.ErrSignatureRejected))
+				})
+			})
+
+			Context("that requires a signature", func() {
+				BeforeEach(func() {
+					signedBy, err := signature.NewPRSignedByKeyData(
+						signature.SBKeyTypeGPGKeys,
+						[]byte("some-key"),
+						signature.NewPRMMatchRepoDigestOrExact(),
+					)
+					Expect(err).NotTo(HaveOccurred())
+					policy = &signature.Policy{Default: signature.PolicyRequirements{signedBy}}
+				})
+
+				It("should error when the image is not signed", func() {
+					_, err := fetchWithPolicy()
+					Expect(err).To(MatchError(ContainSubstring("image rejected by signature policy: A signature was required, but no signature exists")))
+				})
+			})
+		})
+
+		Context("with a multi-arch image index", func() {
+			var indexDigest digest.Digest
+
+			BeforeEach(func() {
+				indexDigest = multiArchImage(tag,
+					v1.Platform{OS: "linux", Architecture: "amd64"},
+					v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+				)
+			})
+
+			Context("when the index contains the requested platform", func() {
+				JustBeforeEach(func() {
+					ctx.OSChoice = "linux"
+					ctx.ArchitectureChoice = "arm64"
+				})
+
+				It("should return the metadata of the matching image", func() {
+					imgConfig, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp-arm64"}))
+				})
+
+				It("should return the digest of the index", func() {
+					imgMetadata, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(imgMetadata.ManifestDigest).To(Equal(indexDigest))
+				})
+
+				Context("when referenced by digest", func() {
+					JustBeforeEach(func() {
+						dockerRef.Tag = "not_some_tag"
+						dockerRef.Digest = indexDigest
+					})
+
+					It("should fetch the image by digest", func() {
+						imgMetadata, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp-arm64"}))
+						Expect(imgMetadata.ManifestDigest).To(Equal(indexDigest))
+					})
+				})
+			})
+
+			Context("when the index does not contain the requested platform", func() {
+				JustBeforeEach(func() {
+					ctx.OSChoice = "linux"
+					ctx.ArchitectureChoice = "s390x"
+				})
+
+				It("should error with the available platforms", func() {
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
+					Expect(err).To(MatchError("no image found for platform linux/s390x; available platforms: linux/amd64, linux/arm64/v8"))
+
+					var platformErr *helpers.UnsupportedPlatformError
+					Expect(errors.As(err, &platformErr)).To(BeTrue())
+					Expect(platformErr.Available).To(Equal([]string{"linux/amd64", "linux/arm64/v8"}))
+				})
+			})
+		})
+
+		Context("when the network connection is slow getting the image manifest", func() {
+			BeforeEach(func() {
+				v2Schema2Manifest(serverResponseConfig{
+					ImageConfig:           v1.ImageConfig{},
+					ImageTag:              tag,
+					WithSlowImageManifest: true,
+				})
+			})
+
+			It("should retry 3 times", func() {
+				stderr := gbytes.NewBuffer()
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .* retry attempt: 1`))
+				Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .* retry attempt: 2`))
+				Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .* retry attempt: 3`))
+			})
+		})
+
+		Context("when the network connection is slow getting the image config", func() {
+			BeforeEach(func() {
+				v2Schema2Manifest(serverResponseConfig{
+					ImageConfig:         v1.ImageConfig{},
+					ImageTag:            tag,
+					WithSlowImageConfig: true,
+				})
+			})
+
+			It("should retry 3 times", func() {
+				stderr := gbytes.NewBuffer()
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stderr).To(gbytes.Say(`Failed getting docker image config by tag: .* retry attempt: 1`))
+				Expect(stderr).To(gbytes.Say(`Failed getting docker image config by tag: .* retry attempt: 2`))
+				Expect(stderr).To(gbytes.Say(`Failed getting docker image config by tag: .* retry attempt: 3`))
+			})
+		})
+
+		Describe("retry classification", func() {
+			var stderr *gbytes.Buffer
+
+			respondToManifest := func(statusCode int, body string, header http.Header) {
+				server.RouteToHandler("GET", "/v2/", ghttp.RespondWith(http.StatusOK, ""))
+				server.RouteToHandler("GET", "/v2/some_user/some_repo/manifests/latest", ghttp.RespondWith(statusCode, body, header))
+			}
+
+			BeforeEach(func() {
+				stderr = gbytes.NewBuffer()
+			})
+
+			Context("when the manifest is unknown", func() {
+				BeforeEach(func() {
+					respondToManifest(http.StatusNotFound, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`, nil)
+				})
+
+				It("should fail without retrying", func() {
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+					Expect(err).To(MatchError(ContainSubstring("(not found after 1 attempt)")))
+					var registryErr *helpers.RegistryError
+					Expect(errors.As(err, &registryErr)).To(BeTrue())
+					Expect(registryErr.Kind).To(Equal(helpers.NotFoundError))
+					Expect(stderr).To(gbytes.Say(`Failed getting docker image manifest by tag: .*manifest unknown \(attempt 1 of 4, not found\)`))
+					Expect(stderr).NotTo(gbytes.Say("Going to retry"))
+				})
+			})
+
+			Context("when the credentials are rejected", func() {
+				BeforeEach(func() {
+					respondToManifest(http.StatusUnauthorized, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, nil)
+				})
+
+				It("should fail without retrying", func() {
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+					Expect(err).To(MatchError(ContainSubstring("(unauthorized after 1 attempt)")))
+					Expect(stderr).NotTo(gbytes.Say("Going to retry"))
+				})
+			})
+
+			Context("when the registry rate limits the requests", func() {
+				BeforeEach(func() {
+					// the docker transport retries each request after its
+					// Retry-After delay before the attempt fails
+					respondToManifest(
+						http.StatusTooManyRequests,
+						`{"errors":[{"code":"TOOMANYREQUESTS","message":"pull rate limit exceeded"}]}`,
+						http.Header{"Retry-After": []string{"0"}},
+					)
+				})
+
+				It("should retry every attempt after the maximum backoff", func() {
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+					Expect(err).To(MatchError(ContainSubstring("(rate limited after 4 attempts)")))
+					Expect(stderr).To(gbytes.Say(`\(attempt 1 of 4, rate limited\) Going to retry attempt: 1 in 10ms`))
+					Expect(stderr).To(gbytes.Say(`\(attempt 3 of 4, rate limited\) Going to retry attempt: 3 in 10ms`))
+					Expect(stderr).To(gbytes.Say(`\(attempt 4 of 4, rate limited\)\n`))
+				})
+			})
+
+			Context("when the registry keeps failing with transient errors", func() {
+				BeforeEach(func() {
+					respondToManifest(http.StatusServiceUnavailable, "", nil)
+				})
+
+				It("should give up after the maximum number of attempts", func() {
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logging.New(stderr, logging.TextFormat))
+					Expect(err).To(MatchError(ContainSubstring("(transient error after 4 attempts)")))
+					Expect(stderr).To(gbytes.Say(`\(attempt 1 of 4, transient error\) Going to retry attempt: 1`))
+					Expect(stderr).To(gbytes.Say(`\(attempt 2 of 4, transient error\) Going to retry attempt: 2`))
+					Expect(stderr).To(gbytes.Say(`\(attempt 3 of 4, transient error\) Going to retry attempt: 3`))
+				})
+			})
+		})
+
+		Context("with a valid repository:tag reference", func() {
+			BeforeEach(func() {
+				v2Schema2Manifest(serverResponseConfig{
+					ImageConfig: v1.ImageConfig{Cmd: []string{"dockerapp"}},
+					ImageTag:    tag,
 				})
 			})
 
 			It("should not error", func() {
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
 			It("should return the top-most image layer metadata", func() {
-				imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(imgConfig).NotTo(BeNil())
 				Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
 			})
+
+			It("should describe the image manifest", func() {
+				configBytes, err := json.Marshal(v1.Image{Config: v1.ImageConfig{Cmd: []string{"dockerapp"}}})
+				Expect(err).NotTo(HaveOccurred())
+
+				imgMetadata, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(imgMetadata.Size).To(Equal(int64(1234)))
+				Expect(imgMetadata.Layers).To(Equal(2))
+				Expect(imgMetadata.MediaType).To(Equal(manifest.DockerV2Schema2MediaType))
+				Expect(imgMetadata.ConfigDigest).To(Equal(digest.FromBytes(configBytes)))
+			})
 		})
 
 		Context("when the image exposes custom ports", func() {
@@ -547,12 +1317,12 @@ var _ = Describe("Builder helpers", func() {
 			})
 
 			It("should not error", func() {
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
 			It("should return the exposed ports", func() {
-				imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(imgConfig).NotTo(BeNil())
 				Expect(imgConfig.ExposedPorts).To(HaveKeyWithValue("8080/tcp", struct{}{}))
 			})
@@ -569,12 +1339,12 @@ var _ = Describe("Builder helpers", func() {
 			})
 
 			It("should not error", func() {
-				_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
 			It("should return the top-most image layer metadata", func() {
-				imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+				imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 				Expect(imgConfig).NotTo(BeNil())
 				Expect(imgConfig.Cmd).NotTo(BeNil())
 				Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
@@ -586,7 +1356,7 @@ var _ = Describe("Builder helpers", func() {
 				})
 
 				It("should error", func() {
-					_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("https"))
 				})
@@ -604,12 +1374,12 @@ var _ = Describe("Builder helpers", func() {
 
 			Context("with a valid repository:tag reference", func() {
 				It("should not error", func() {
-					_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(err).NotTo(HaveOccurred())
 				})
 
 				It("should return the top-most image layer metadata", func() {
-					imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(imgConfig).NotTo(BeNil())
 					Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
 				})
@@ -627,12 +1397,12 @@ var _ = Describe("Builder helpers", func() {
 
 			Context("with a valid repository:tag reference", func() {
 				It("should not error", func() {
-					_, err := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					_, err := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(err).NotTo(HaveOccurred())
 				})
 
 				It("should return the top-most image layer metadata", func() {
-					imgConfig, _ := helpers.FetchMetadata(registryURL, repoName, tag, ctx, os.Stderr)
+					imgConfig, _ := helpers.FetchMetadata(context.Background(), dockerRef, ctx, nil, retryPolicy, logger)
 					Expect(imgConfig).NotTo(BeNil())
 					Expect(imgConfig.Cmd).To(Equal([]string{"dockerapp"}))
 				})
@@ -640,6 +1410,468 @@ var _ = Describe("Builder helpers", func() {
 		})
 	})
 
+	Describe("CacheImage", func() {
+		var (
+			sourceRegistry *testhelpers.FakeRegistry
+			cacheRegistry  *testhelpers.FakeRegistry
+			srcRef         helpers.Reference
+			srcCtx         *types.SystemContext
+			destCtx        *types.SystemContext
+			sourceDigest   digest.Digest
+			layer          []byte
+		)
+
+		BeforeEach(func() {
+			sourceRegistry = testhelpers.NewFakeRegistry()
+			cacheRegistry = testhelpers.NewFakeRegistry()
+
+			var compressed bytes.Buffer
+			gzipWriter := gzip.NewWriter(&compressed)
+			_, err := gzipWriter.Write([]byte("some-layer-content"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gzipWriter.Close()).To(Succeed())
+			layer = compressed.Bytes()
+
+			sourceDigest, err = sourceRegistry.AddImage("some_user/some_repo", "some-tag", v1.Image{
+				Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+				Config:   v1.ImageConfig{Cmd: []string{"dockerapp"}},
+			}, layer)
+			Expect(err).NotTo(HaveOccurred())
+
+			srcRef = helpers.Reference{RegistryURL: sourceRegistry.Addr(), RepoName: "some_user/some_repo", Tag: "some-tag"}
+			srcCtx = &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+			destCtx = &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+		})
+
+		AfterEach(func() {
+			sourceRegistry.Close()
+			cacheRegistry.Close()
+		})
+
+		It("copies the manifest and blobs into the registry", func() {
+			cachedRef, manifestDigest, err := helpers.CacheImage(context.Background(), srcRef, srcCtx, nil, cacheRegistry.Addr(), destCtx, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cachedRef).To(Equal(helpers.Reference{RegistryURL: cacheRegistry.Addr(), RepoName: "some_user/some_repo", Tag: "some-tag"}))
+			Expect(manifestDigest).To(Equal(sourceDigest))
+
+			cachedManifest, ok := cacheRegistry.Manifest("some_user/some_repo", "some-tag")
+			Expect(ok).To(BeTrue())
+			Expect(digest.FromBytes(cachedManifest.Content)).To(Equal(manifestDigest))
+			Expect(cacheRegistry.HasBlob(digest.FromBytes(layer))).To(BeTrue())
+		})
+
+		It("caches an image that can be fetched from the registry", func() {
+			cachedRef, _, err := helpers.CacheImage(context.Background(), srcRef, srcCtx, nil, cacheRegistry.Addr(), destCtx, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			imgMetadata, err := helpers.FetchMetadata(context.Background(), cachedRef, destCtx, nil, retryPolicy, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp"}))
+		})
+
+		Context("when the source is referenced by digest", func() {
+			BeforeEach(func() {
+				srcRef.Tag = ""
+				srcRef.Digest = sourceDigest
+			})
+
+			It("caches the image under the same digest", func() {
+				cachedRef, manifestDigest, err := helpers.CacheImage(context.Background(), srcRef, srcCtx, nil, cacheRegistry.Addr(), destCtx, logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(cachedRef.Digest).To(Equal(sourceDigest))
+				Expect(manifestDigest).To(Equal(sourceDigest))
+				_, ok := cacheRegistry.Manifest("some_user/some_repo", sourceDigest.String())
+				Expect(ok).To(BeTrue())
+			})
+		})
+
+		Context("when the source is a multi-arch image referenced by digest", func() {
+			var (
+				indexDigest digest.Digest
+				armDigest   digest.Digest
+			)
+
+			BeforeEach(func() {
+				var err error
+				armDigest, err = sourceRegistry.AddImage("some_user/some_repo", "some-arm-tag", v1.Image{
+					Platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+					Config:   v1.ImageConfig{Cmd: []string{"dockerapp-arm64"}},
+				}, layer)
+				Expect(err).NotTo(HaveOccurred())
+				indexDigest, err = sourceRegistry.AddIndex("some_user/some_repo", "multi-arch", sourceDigest, armDigest)
+				Expect(err).NotTo(HaveOccurred())
+
+				srcRef.Tag = ""
+				srcRef.Digest = indexDigest
+				srcCtx.ArchitectureChoice = "amd64"
+				srcCtx.OSChoice = "linux"
+			})
+
+			It("caches the whole index under its digest", func() {
+				cachedRef, manifestDigest, err := helpers.CacheImage(context.Background(), srcRef, srcCtx, nil, cacheRegistry.Addr(), destCtx, logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(cachedRef.Digest).To(Equal(indexDigest))
+				Expect(manifestDigest).To(Equal(indexDigest))
+				for _, cached := range []digest.Digest{indexDigest, sourceDigest, armDigest} {
+					_, ok := cacheRegistry.Manifest("some_user/some_repo", cached.String())
+					Expect(ok).To(BeTrue(), cached.String())
+				}
+
+				imgMetadata, err := helpers.FetchMetadata(context.Background(), cachedRef, destCtx, nil, retryPolicy, logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp"}))
+			})
+		})
+
+		Context("when the registry requires TLS", func() {
+			BeforeEach(func() {
+				destCtx = &types.SystemContext{}
+			})
+
+			It("does not fall back to HTTP", func() {
+				_, _, err := helpers.CacheImage(context.Background(), srcRef, srcCtx, nil, cacheRegistry.Addr(), destCtx, logger)
+				Expect(err).To(MatchError(ContainSubstring("server gave HTTP response to HTTPS client")))
+			})
+		})
+
+		Context("when the signature policy rejects the source image", func() {
+			It("does not copy the image", func() {
+				policyContext, err := signature.NewPolicyContext(&signature.Policy{
+					Default: signature.PolicyRequirements{signature.NewPRReject()},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer policyContext.Destroy()
+
+				_, _, err = helpers.CacheImage(context.Background(), srcRef, srcCtx, policyContext, cacheRegistry.Addr(), destCtx, logger)
+				Expect(err).To(MatchError(ContainSubstring("is rejected by policy")))
+				_, ok := cacheRegistry.Manifest("some_user/some_repo", "some-tag")
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when the source image does not exist", func() {
+			BeforeEach(func() {
+				srcRef.Tag = "not_some_tag"
+			})
+
+			It("errors", func() {
+				_, _, err := helpers.CacheImage(context.Background(), srcRef, srcCtx, nil, cacheRegistry.Addr(), destCtx, logger)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("images on the file system", func() {
+		var (
+			imagesDir      string
+			layoutRef      helpers.Reference
+			manifestDigest digest.Digest
+			sys            *types.SystemContext
+		)
+
+		// copyTo copies the OCI layout into another local transport.
+		copyTo := func(transport types.ImageTransport, within string) helpers.Reference {
+			policyContext, err := signature.NewPolicyContext(&signature.Policy{
+				Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer policyContext.Destroy()
+
+			src, err := layout.ParseReference(layoutRef.Path)
+			Expect(err).NotTo(HaveOccurred())
+			dest, err := transport.ParseReference(within)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = copy.Image(context.Background(), policyContext, dest, src, &copy.Options{SourceCtx: sys, DestinationCtx: sys})
+			Expect(err).NotTo(HaveOccurred())
+
+			ref, err := helpers.ParseDockerRef(transport.Name() + ":" + within)
+			Expect(err).NotTo(HaveOccurred())
+			return ref
+		}
+
+		BeforeEach(func() {
+			imagesDir = GinkgoT().TempDir()
+			sys = &types.SystemContext{OSChoice: "linux", ArchitectureChoice: "amd64"}
+
+			var compressed bytes.Buffer
+			gzipWriter := gzip.NewWriter(&compressed)
+			_, err := gzipWriter.Write([]byte("some-layer-content"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gzipWriter.Close()).To(Succeed())
+
+			manifestDigest, err = testhelpers.WriteOCILayout(filepath.Join(imagesDir, "app"), "1.0", v1.Image{
+				Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+				Config:   v1.ImageConfig{Cmd: []string{"dockerapp"}},
+				RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromString("some-layer-content")}},
+			}, compressed.Bytes())
+			Expect(err).NotTo(HaveOccurred())
+
+			layoutRef, err = helpers.ParseDockerRef("oci:" + filepath.Join(imagesDir, "app") + ":1.0")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("fetches the metadata from an OCI layout", func() {
+			imgMetadata, err := helpers.FetchMetadata(context.Background(), layoutRef, sys, nil, retryPolicy, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp"}))
+			Expect(imgMetadata.ManifestDigest).To(Equal(manifestDigest))
+			Expect(imgMetadata.Layers).To(Equal(1))
+		})
+
+		It("fetches the metadata from an OCI archive", func() {
+			ref := copyTo(ociarchive.Transport, filepath.Join(imagesDir, "app.tar")+":1.0")
+			imgMetadata, err := helpers.FetchMetadata(context.Background(), ref, sys, nil, retryPolicy, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp"}))
+		})
+
+		It("fetches the metadata from a docker archive", func() {
+			ref := copyTo(dockerarchive.Transport, filepath.Join(imagesDir, "docker.tar")+":example.com/team/app:2.0")
+			imgMetadata, err := helpers.FetchMetadata(context.Background(), ref, sys, nil, retryPolicy, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp"}))
+		})
+
+		It("fetches the metadata from a directory", func() {
+			ref := copyTo(directory.Transport, filepath.Join(imagesDir, "dir"))
+			imgMetadata, err := helpers.FetchMetadata(context.Background(), ref, sys, nil, retryPolicy, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imgMetadata.Cmd).To(Equal([]string{"dockerapp"}))
+			Expect(imgMetadata.ManifestDigest).To(Equal(manifestDigest))
+		})
+
+		It("fails without retrying when the image does not exist", func() {
+			ref, err := helpers.ParseDockerRef("oci:" + filepath.Join(imagesDir, "missing") + ":1.0")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = helpers.FetchMetadata(context.Background(), ref, sys, nil, retryPolicy, logger)
+			var registryErr *helpers.RegistryError
+			Expect(errors.As(err, &registryErr)).To(BeTrue())
+			Expect(registryErr.Kind).To(Equal(helpers.NotFoundError))
+			Expect(registryErr.Attempts).To(Equal(1))
+		})
+
+		It("caches the image in a registry", func() {
+			cacheRegistry := testhelpers.NewFakeRegistry()
+			defer cacheRegistry.Close()
+			destCtx := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+
+			cachedRef, cachedDigest, err := helpers.CacheImage(context.Background(), layoutRef, sys, nil, cacheRegistry.Addr(), destCtx, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cachedRef).To(Equal(helpers.Reference{RegistryURL: cacheRegistry.Addr(), RepoName: "app", Tag: "1.0"}))
+			Expect(cachedDigest).To(Equal(manifestDigest))
+
+			_, ok := cacheRegistry.Manifest("app", "1.0")
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Describe("DockerConfig", func() {
+		var (
+			configDir    string
+			configJSON   string
+			dockerConfig *helpers.DockerConfig
+		)
+
+		basicAuth := func(username, password string) string {
+			return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		}
+
+		writeCredentialHelper := func(name, script string) {
+			Expect(os.WriteFile(
+				filepath.Join(configDir, "docker-credential-"+name),
+				[]byte("#!/bin/sh\n"+script),
+				0755,
+			)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = os.MkdirTemp("", "docker-config")
+			Expect(err).NotTo(HaveOccurred())
+
+			originalPath := os.Getenv("PATH")
+			os.Setenv("PATH", configDir+string(os.PathListSeparator)+originalPath)
+			DeferCleanup(os.Setenv, "PATH", originalPath)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(configDir)
+		})
+
+		JustBeforeEach(func() {
+			configPath := filepath.Join(configDir, "config.json")
+			Expect(os.WriteFile(configPath, []byte(configJSON), 0600)).To(Succeed())
+
+			var err error
+			dockerConfig, err = helpers.LoadDockerConfig(configPath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("with auths entries", func() {
+			BeforeEach(func() {
+				configJSON = fmt.Sprintf(`{"auths": {
+					"https://index.docker.io/v1/": {"auth": "%s"},
+					"http://registry.example.com:5000/v2/": {"auth": "%s"},
+					"tokens.example.com": {"identitytoken": "some-token"}
+				}}`, basicAuth("hub-user", "hub:password"), basicAuth("example-user", "example-password"))
+			})
+
+			It("matches Docker Hub through the login server entry", func() {
+				authConfig, err := dockerConfig.Credentials(helpers.DockerHubHostname)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{Username: "hub-user", Password: "hub:password"}))
+			})
+
+			It("matches entries with a scheme and a path", func() {
+				authConfig, err := dockerConfig.Credentials("registry.example.com:5000")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{Username: "example-user", Password: "example-password"}))
+			})
+
+			It("returns identity tokens", func() {
+				authConfig, err := dockerConfig.Credentials("tokens.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{IdentityToken: "some-token"}))
+			})
+
+			It("returns empty credentials for unknown registries", func() {
+				authConfig, err := dockerConfig.Credentials("unknown.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{}))
+			})
+		})
+
+		Context("with an invalid auth entry", func() {
+			BeforeEach(func() {
+				configJSON = fmt.Sprintf(`{"auths": {"registry.example.com": {"auth": "%s"}}}`,
+					base64.StdEncoding.EncodeToString([]byte("no-separator")))
+			})
+
+			It("errors", func() {
+				_, err := dockerConfig.Credentials("registry.example.com")
+				Expect(err).To(MatchError(ContainSubstring("invalid auth for registry [registry.example.com]")))
+			})
+		})
+
+		Context("with credential helpers", func() {
+			BeforeEach(func() {
+				writeCredentialHelper("registry-helper", `read server
+echo "{\"ServerURL\":\"$server\",\"Username\":\"helper-user\",\"Secret\":\"secret-for-$server\"}"
+`)
+				writeCredentialHelper("token-store", `read server
+echo "{\"ServerURL\":\"$server\",\"Username\":\"<token>\",\"Secret\":\"token-for-$server\"}"
+`)
+				writeCredentialHelper("empty-store", `echo "credentials not found in native keychain"
+exit 1
+`)
+				configJSON = fmt.Sprintf(`{
+					"auths": {"registry.example.com": {"auth": "%s"}, "other.example.com": {}},
+					"credHelpers": {"registry.example.com": "registry-helper"},
+					"credsStore": "token-store"
+				}`, basicAuth("file-user", "file-password"))
+			})
+
+			It("prefers the credHelpers entry for the registry", func() {
+				authConfig, err := dockerConfig.Credentials("registry.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{Username: "helper-user", Password: "secret-for-registry.example.com"}))
+			})
+
+			It("falls back to the credsStore", func() {
+				authConfig, err := dockerConfig.Credentials("unknown.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{IdentityToken: "token-for-unknown.example.com"}))
+			})
+
+			It("uses the credsStore for auths entries without credentials", func() {
+				authConfig, err := dockerConfig.Credentials("other.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig).To(Equal(types.DockerAuthConfig{IdentityToken: "token-for-other.example.com"}))
+			})
+
+			It("asks the helpers for Docker Hub through the login server", func() {
+				authConfig, err := dockerConfig.Credentials(helpers.DockerHubHostname)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(authConfig.IdentityToken).To(Equal("token-for-" + helpers.DockerHubLoginServer))
+			})
+
+			Context("when the helper has no credentials", func() {
+				BeforeEach(func() {
+					configJSON = `{"credsStore": "empty-store"}`
+				})
+
+				It("returns empty credentials", func() {
+					authConfig, err := dockerConfig.Credentials("registry.example.com")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(authConfig).To(Equal(types.DockerAuthConfig{}))
+				})
+			})
+
+			Context("when the helper is missing", func() {
+				BeforeEach(func() {
+					configJSON = `{"credsStore": "missing-store"}`
+				})
+
+				It("errors", func() {
+					_, err := dockerConfig.Credentials("registry.example.com")
+					Expect(err).To(MatchError(ContainSubstring("credential helper [missing-store] failed for [registry.example.com]")))
+				})
+			})
+		})
+	})
+
+	Describe("LoadDockerConfig", func() {
+		It("errors when the file is not valid JSON", func() {
+			configFile, err := os.CreateTemp("", "config.json")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(configFile.Name())
+			_, err = configFile.WriteString("not-json")
+			Expect(err).NotTo(HaveOccurred())
+			configFile.Close()
+
+			_, err = helpers.LoadDockerConfig(configFile.Name())
+			Expect(err).To(MatchError(ContainSubstring("invalid docker config [" + configFile.Name() + "]")))
+		})
+	})
+
+	Describe("SaveFailure", func() {
+		var outputDir string
+
+		BeforeEach(func() {
+			var err error
+			outputDir, err = os.MkdirTemp(os.TempDir(), "failure")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(outputDir)
+		})
+
+		It("should write the failure document", func() {
+			filename := path.Join(outputDir, "failure.json")
+			err := helpers.SaveFailure(filename, dockerapplifecycle.StagingFailure{
+				Code:     dockerapplifecycle.FailureImageNotFound,
+				Message:  "manifest unknown",
+				Registry: "registry.example.com",
+				Repo:     "some-repo",
+				Tag:      "latest",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resultJSON(filename)).To(MatchJSON(`{
+				"code": "IMAGE_NOT_FOUND",
+				"message": "manifest unknown",
+				"registry": "registry.example.com",
+				"repo": "some-repo",
+				"tag": "latest"
+			}`))
+		})
+	})
+
 	Context("SaveMetadata", func() {
 		var metadata protocol.DockerImageMetadata
 		var outputDir string
@@ -651,7 +1883,12 @@ var _ = Describe("Builder helpers", func() {
 					Entrypoint: []string{"fake-cmd", "fake-arg0"},
 					Workdir:    "/fake-workdir",
 				},
-				DockerImage: "cloudfoundry/diego-docker-app",
+				DockerImage:             "cloudfoundry/diego-docker-app",
+				DockerImageDigest:       "sha256:4aac0b4b24a08d4e4d01f3ba30ef3e1ad7bcef4d4df31c4a1eeb2fbc8e5b6b02",
+				DockerImageSize:         1234,
+				DockerImageLayers:       2,
+				DockerImageMediaType:    "application/vnd.docker.distribution.manifest.v2+json",
+				DockerImageConfigDigest: "sha256:7f6ea8d1b8a1a8c0e2a8a0c4e1d0e3b1c9f3c5c2f9e4b7a6d5c3b2a1f0e9d8c7",
 			}
 		})
 
@@ -681,6 +1918,20 @@ var _ = Describe("Builder helpers", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
 
+			It("should replace an existing file without leaving temporary files behind", func() {
+				filename := path.Join(outputDir, "result.json")
+				Expect(os.WriteFile(filename, []byte("previous result"), 0644)).To(Succeed())
+
+				err := helpers.SaveMetadata(filename, &metadata)
+				Expect(err).NotTo(HaveOccurred())
+
+				entries, err := os.ReadDir(outputDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
+				Expect(entries[0].Name()).To(Equal("result.json"))
+				Expect(resultJSON(filename)).To(ContainSubstring("cloudfoundry/diego-docker-app"))
+			})
+
 			Describe("the json", func() {
 				verifyMetadata := func(expectedEntryPoint []string, expectedStartCmd string) {
 					err := helpers.SaveMetadata(path.Join(outputDir, "result.json"), &metadata)
@@ -706,6 +1957,11 @@ var _ = Describe("Builder helpers", func() {
 					Expect(stagingResult.ProcessTypes).To(HaveKeyWithValue("web", expectedStartCmd))
 
 					Expect(stagingResult.LifecycleMetadata.DockerImage).To(Equal(metadata.DockerImage))
+					Expect(stagingResult.LifecycleMetadata.DockerImageDigest).To(Equal(metadata.DockerImageDigest))
+					Expect(stagingResult.LifecycleMetadata.DockerImageSize).To(Equal(metadata.DockerImageSize))
+					Expect(stagingResult.LifecycleMetadata.DockerImageLayers).To(Equal(metadata.DockerImageLayers))
+					Expect(stagingResult.LifecycleMetadata.DockerImageMediaType).To(Equal(metadata.DockerImageMediaType))
+					Expect(stagingResult.LifecycleMetadata.DockerImageConfigDigest).To(Equal(metadata.DockerImageConfigDigest))
 				}
 
 				It("should contain the metadata", func() {
@@ -731,6 +1987,41 @@ var _ = Describe("Builder helpers", func() {
 						verifyMetadata(metadata.ExecutionMetadata.Entrypoint, "fake-arg1 fake-arg2")
 					})
 				})
+
+				Context("when the arguments contain shell syntax", func() {
+					BeforeEach(func() {
+						metadata.ExecutionMetadata.Cmd = []string{"--greeting", "hello world", "$HOME"}
+					})
+
+					It("quotes them in the web process", func() {
+						verifyMetadata(metadata.ExecutionMetadata.Entrypoint, `fake-cmd fake-arg0 --greeting 'hello world' '$HOME'`)
+					})
+				})
+
+				Context("with process types from the image labels", func() {
+					It("adds them next to the derived web process", func() {
+						metadata.ProcessTypes = map[string]string{"worker": "bin/worker"}
+						err := helpers.SaveMetadata(path.Join(outputDir, "result.json"), &metadata)
+						Expect(err).NotTo(HaveOccurred())
+
+						var stagingResult dockerapplifecycle.StagingResult
+						Expect(json.Unmarshal(resultJSON(path.Join(outputDir, "result.json")), &stagingResult)).To(Succeed())
+						Expect(stagingResult.ProcessTypes).To(Equal(dockerapplifecycle.ProcessTypes{
+							"web":    "fake-cmd fake-arg0 fake-arg1 fake-arg2",
+							"worker": "bin/worker",
+						}))
+					})
+
+					It("lets them override the web process", func() {
+						metadata.ProcessTypes = map[string]string{"web": "bin/web"}
+						err := helpers.SaveMetadata(path.Join(outputDir, "result.json"), &metadata)
+						Expect(err).NotTo(HaveOccurred())
+
+						var stagingResult dockerapplifecycle.StagingResult
+						Expect(json.Unmarshal(resultJSON(path.Join(outputDir, "result.json")), &stagingResult)).To(Succeed())
+						Expect(stagingResult.ProcessTypes).To(Equal(dockerapplifecycle.ProcessTypes{"web": "bin/web"}))
+					})
+				})
 			})
 		})
 	})
@@ -1 +1,3 @@
+// Programs that import helpers are built, and its tests run, with the
+// containers_image_openpgp build tag, like the builder.
 package helpers // import "code.cloudfoundry.org/dockerapplifecycle/helpers"
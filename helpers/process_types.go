@@ -0,0 +1,59 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/dockerapplifecycle"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ProcessTypesLabel holds a JSON map of process type names to start commands.
+	ProcessTypesLabel = "org.cloudfoundry.process-types"
+	// ProcessLabelPrefix followed by a process type name holds the start command
+	// of that process type. It wins over an entry in ProcessTypesLabel.
+	ProcessLabelPrefix = "org.cloudfoundry.process."
+
+	webProcessType = "web"
+)
+
+var processTypeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// ImageProcessTypes returns the process types declared by the labels of the
+// image. The web process may be left out of the labels when it can be derived
+// from the entrypoint and command of the image.
+func ImageProcessTypes(config v1.ImageConfig) (dockerapplifecycle.ProcessTypes, error) {
+	processTypes := dockerapplifecycle.ProcessTypes{}
+
+	if value, ok := config.Labels[ProcessTypesLabel]; ok {
+		err := json.Unmarshal([]byte(value), &processTypes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %s", ProcessTypesLabel, err.Error())
+		}
+	}
+
+	for label, command := range config.Labels {
+		if name, ok := strings.CutPrefix(label, ProcessLabelPrefix); ok {
+			processTypes[name] = command
+		}
+	}
+
+	for name, command := range processTypes {
+		if !processTypeName.MatchString(name) {
+			return nil, fmt.Errorf("invalid process type name [%s]", name)
+		}
+		if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("empty start command for process type [%s]", name)
+		}
+	}
+
+	_, hasWeb := processTypes[webProcessType]
+	if len(processTypes) > 0 && !hasWeb && len(config.Entrypoint) == 0 && len(config.Cmd) == 0 {
+		return nil, errors.New("no web process type in the image labels and no entrypoint or command to derive it from")
+	}
+	return processTypes, nil
+}
@@ -0,0 +1,176 @@
+package helpers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+	"github.com/containers/image/v5/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+)
+
+// RetryPolicy controls how requests to the registry are retried. Transient
+// errors are retried with exponential backoff and jitter; errors that cannot
+// succeed on retry fail immediately.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    MAX_DOCKER_RETRIES,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// backoff returns the delay before the given retry, doubling for every retry
+// up to MaxBackoff. Half of the delay is randomized so that stagers hitting the
+// same registry do not retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// RegistryErrorKind is the category of a failed registry request.
+type RegistryErrorKind string
+
+const (
+	TransientError    RegistryErrorKind = "transient error"
+	RateLimitedError  RegistryErrorKind = "rate limited"
+	UnauthorizedError RegistryErrorKind = "unauthorized"
+	NotFoundError     RegistryErrorKind = "not found"
+	TLSError          RegistryErrorKind = "TLS error"
+)
+
+func (k RegistryErrorKind) permanent() bool {
+	return k != TransientError && k != RateLimitedError
+}
+
+// RegistryError is returned when a registry request failed with a permanent
+// error or ran out of attempts.
+type RegistryError struct {
+	Kind     RegistryErrorKind
+	Attempts int
+	Err      error
+}
+
+func (e *RegistryError) Error() string {
+	attempts := fmt.Sprintf("%d attempts", e.Attempts)
+	if e.Attempts == 1 {
+		attempts = "1 attempt"
+	}
+	return fmt.Sprintf("%s (%s after %s)", e.Err, e.Kind, attempts)
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// classifyRegistryError tells apart errors that may succeed on retry from
+// errors that will fail the same way every time.
+func classifyRegistryError(err error) RegistryErrorKind {
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return RateLimitedError
+	}
+
+	var unauthorized docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauthorized) {
+		return UnauthorizedError
+	}
+
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) {
+		switch coder.ErrorCode() {
+		case errcode.ErrorCodeTooManyRequests:
+			return RateLimitedError
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied:
+			return UnauthorizedError
+		case v2.ErrorCodeManifestUnknown, v2.ErrorCodeNameUnknown, v2.ErrorCodeBlobUnknown:
+			return NotFoundError
+		}
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return NotFoundError
+	}
+
+	var verificationErr *tls.CertificateVerificationError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verificationErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		return TLSError
+	}
+
+	return TransientError
+}
+
+// withRetries calls operation until it succeeds, fails with a permanent error,
+// or policy.MaxAttempts is reached. Every failed attempt is logged with its
+// reason. Rate limited attempts wait for MaxBackoff, on top of the
+// Retry-After delays the docker transport already honours for each request.
+func withRetries(ctx context.Context, policy RetryPolicy, phase logging.Phase, description string, logger logging.EventLogger, operation func() error) error {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		kind := classifyRegistryError(err)
+		if kind.permanent() || attempt == maxAttempts {
+			logger.Error(phase, fmt.Sprintf("Failed getting docker image %s: %s (attempt %d of %d, %s)", description, err, attempt, maxAttempts, kind), logging.Data{
+				"attempt":      attempt,
+				"max_attempts": maxAttempts,
+				"kind":         string(kind),
+				"error":        err.Error(),
+			})
+			return &RegistryError{Kind: kind, Attempts: attempt, Err: err}
+		}
+
+		delay := policy.backoff(attempt)
+		if kind == RateLimitedError {
+			delay = policy.MaxBackoff
+		}
+		logger.Warn(phase, fmt.Sprintf("Failed getting docker image %s: %s (attempt %d of %d, %s) Going to retry attempt: %d in %s", description, err, attempt, maxAttempts, kind, attempt, delay), logging.Data{
+			"attempt":      attempt,
+			"max_attempts": maxAttempts,
+			"kind":         string(kind),
+			"error":        err.Error(),
+			"retry_in":     delay.String(),
+		})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
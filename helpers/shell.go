@@ -0,0 +1,36 @@
+package helpers
+
+import (
+	"regexp"
+	"strings"
+)
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// reservedWords are the words that start shell syntax rather than a command
+// when they come first, including the ones bash and ksh add. The others,
+// such as ! and {, are not shellSafe anyway.
+var reservedWords = map[string]bool{
+	"case": true, "do": true, "done": true, "elif": true, "else": true, "esac": true,
+	"fi": true, "for": true, "function": true, "if": true, "in": true, "select": true,
+	"then": true, "time": true, "until": true, "while": true,
+}
+
+// ShellQuote joins argv into a command that /bin/sh -c runs with exactly
+// these arguments. Arguments with characters the shell would interpret are
+// single-quoted; the others are left as they are for readability. A first
+// word that is a reserved word or contains an = is always quoted, as the
+// shell would take it for syntax or a variable assignment rather than the
+// command.
+func ShellQuote(argv []string) string {
+	quoted := make([]string, 0, len(argv))
+	for i, arg := range argv {
+		first := i == 0 && (reservedWords[arg] || strings.Contains(arg, "="))
+		if shellSafe.MatchString(arg) && !first {
+			quoted = append(quoted, arg)
+			continue
+		}
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
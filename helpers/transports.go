@@ -0,0 +1,81 @@
+package helpers
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containers/image/v5/directory"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+)
+
+const directoryTransport = "dir"
+
+// localTransports are the containers/image transports that read images from
+// the file system instead of a registry, keyed by their reference prefix.
+var localTransports = map[string]types.ImageTransport{
+	"oci":              layout.Transport,
+	"oci-archive":      ociarchive.Transport,
+	"docker-archive":   dockerarchive.Transport,
+	directoryTransport: directory.Transport,
+}
+
+var (
+	localImageTag        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	invalidRepoNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// splitLocalRef splits references such as "oci:/images/app:1.0" into the
+// transport and the transport specific reference. Only paths that are absolute
+// or start with a dot are accepted, so that docker references such as
+// "dir:latest" keep referring to a registry.
+func splitLocalRef(dockerRef string) (string, string, bool) {
+	transport, within, ok := strings.Cut(dockerRef, ":")
+	if !ok || localTransports[transport] == nil {
+		return "", "", false
+	}
+	if !strings.HasPrefix(within, "/") && !strings.HasPrefix(within, ".") {
+		return "", "", false
+	}
+	return transport, within, true
+}
+
+// parseLocalRef parses the reference of an image on the file system. The
+// repository name and tag that the image is cached under come from the name
+// recorded in a docker archive, or otherwise from the file name and the OCI
+// image name.
+func parseLocalRef(transport, within string) (Reference, error) {
+	imageRef, err := localTransports[transport].ParseReference(within)
+	if err != nil {
+		return Reference{}, fmt.Errorf("invalid image reference [%s:%s]: %s", transport, within, err.Error())
+	}
+
+	ref := Reference{Transport: transport, Path: within, Tag: "latest"}
+	if named := imageRef.DockerReference(); named != nil {
+		ref.RepoName = reference.Path(named)
+		if tagged, ok := named.(reference.Tagged); ok {
+			ref.Tag = tagged.Tag()
+		}
+		return ref, nil
+	}
+
+	file, image := within, ""
+	if transport != directoryTransport {
+		file, image, _ = strings.Cut(within, ":")
+	}
+	if localImageTag.MatchString(image) {
+		ref.Tag = image
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+	ref.RepoName = strings.Trim(invalidRepoNameChars.ReplaceAllString(name, "-"), "-")
+	if ref.RepoName == "" {
+		ref.RepoName = "image"
+	}
+	return ref, nil
+}
@@ -0,0 +1,135 @@
+package launch
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/credhub-cli/credhub"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+)
+
+const (
+	PlatformOptionsEnvVar  = "VCAP_PLATFORM_OPTIONS"
+	CFSystemCertPathEnvVar = "CF_SYSTEM_CERT_PATH"
+)
+
+type PlatformOptions struct {
+	CredhubURI string `json:"credhub-uri"`
+}
+
+// Interpolator replaces the credhub-ref entries of VCAP_SERVICES with the
+// credentials stored in CredHub. *credhub.CredHub is an Interpolator.
+type Interpolator interface {
+	InterpolateString(vcapServices string) (string, error)
+}
+
+// CredHubFactory creates the Interpolator for the CredHub at uri, which
+// authenticates with the instance identity certificate and key and trusts
+// caCerts.
+type CredHubFactory func(uri, certPath, keyPath string, caCerts []string) (Interpolator, error)
+
+// NewCredHub is the CredHubFactory of the credhub-cli client.
+func NewCredHub(uri, certPath, keyPath string, caCerts []string) (Interpolator, error) {
+	ch, err := credhub.New(uri, credhub.ClientCert(certPath, keyPath), credhub.CaCerts(caCerts...))
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func credhubError(message string) *Error {
+	return &Error{ExitCode: 4, Phase: logging.PhaseCredhub, Message: message}
+}
+
+func interpolateVCAPServices(env *environment, platformOptions *PlatformOptions, newCredHub CredHubFactory) error {
+	if platformOptions == nil || platformOptions.CredhubURI == "" {
+		return nil
+	}
+
+	vcapServices := env.get("VCAP_SERVICES")
+	if !strings.Contains(vcapServices, `"credhub-ref"`) {
+		return nil
+	}
+
+	certPath := env.get("CF_INSTANCE_CERT")
+	keyPath := env.get("CF_INSTANCE_KEY")
+	rootCAs, err := rootCAs(env)
+	if err != nil {
+		return err
+	}
+
+	credhubURI := platformOptions.CredhubURI
+	_, err = url.ParseRequestURI(credhubURI)
+	if err != nil {
+		return credhubError(fmt.Sprintf("Invalid CredHub URI: '%s'", credhubURI))
+	}
+
+	if certPath == "" || keyPath == "" {
+		return credhubError(fmt.Sprintf("Unable to load instance identity credentials; CF_INSTANCE_CERT: '%s', CF_INSTANCE_KEY: '%s'", certPath, keyPath))
+	}
+
+	ch, err := newCredHub(credhubURI, certPath, keyPath, rootCAs)
+	if err != nil {
+		return credhubError(fmt.Sprintf("Unable to create a credhub client: %s", err))
+	}
+
+	interpolatedVcapServices, err := ch.InterpolateString(vcapServices)
+	if err != nil {
+		return credhubError(formatCredHubErrorMessage(err))
+	}
+
+	env.set("VCAP_SERVICES", interpolatedVcapServices)
+	return nil
+}
+
+func rootCAs(env *environment) ([]string, error) {
+	certsPath := env.get(CFSystemCertPathEnvVar)
+	pattern := path.Join(certsPath, "*.crt")
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, credhubError(fmt.Sprintf("Unable to locate system certs: %s", err))
+	}
+	certs := []string{}
+	for _, m := range matches {
+		content, err := os.ReadFile(m)
+		if err != nil {
+			return nil, credhubError(fmt.Sprintf("Unable to read system certs: %s", err))
+		}
+		certs = append(certs, string(content))
+	}
+	return certs, nil
+}
+
+func platformOptions(env *environment) (*PlatformOptions, error) {
+	jsonPlatformOptions := env.get(PlatformOptionsEnvVar)
+	if jsonPlatformOptions == "" {
+		return nil, nil
+	}
+	platformOptions := PlatformOptions{}
+	err := json.Unmarshal([]byte(jsonPlatformOptions), &platformOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &platformOptions, nil
+}
+
+func formatCredHubErrorMessage(err error) string {
+	var unknownAuthErr *x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthErr) {
+		return fmt.Sprintf("Unable to verify CredHub server: %s", unknownAuthErr)
+	}
+
+	if typeErr, ok := err.(*url.Error); ok {
+		return formatCredHubErrorMessage(typeErr.Err)
+	}
+
+	return fmt.Sprintf("Unable to interpolate credhub references: %s", err)
+}
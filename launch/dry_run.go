@@ -0,0 +1,69 @@
+package launch
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+)
+
+// DryRun describes what a launch plan would run, so that apps that fail to
+// start can be debugged. Env lists only the variables that the plan adds or
+// changes. Secrets are redacted.
+//
+// Dry runs are planned with SkipInterpolation, so VCAP_SERVICES keeps its
+// credhub-ref entries.
+type DryRun struct {
+	Argv    []string   `json:"argv"`
+	Workdir string     `json:"workdir"`
+	Env     EnvChanges `json:"env"`
+	User    *User      `json:"user,omitempty"`
+}
+
+// EnvChanges are the variables of a launch plan that differ from the
+// environment of the launcher.
+type EnvChanges struct {
+	Added   map[string]string `json:"added,omitempty"`
+	Changed map[string]string `json:"changed,omitempty"`
+}
+
+// DryRun compares the plan with env, the environment it was planned from.
+func (p LaunchPlan) DryRun(env []string) DryRun {
+	dryRun := DryRun{Workdir: p.Workdir, User: p.User}
+	for _, arg := range p.Argv {
+		dryRun.Argv = append(dryRun.Argv, logging.RedactURLCredentials(arg))
+	}
+
+	before := newEnvironment(env)
+	seen := map[string]bool{}
+	for _, kv := range p.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		previous, existed := before.lookup(key)
+		switch {
+		case !existed:
+			if dryRun.Env.Added == nil {
+				dryRun.Env.Added = map[string]string{}
+			}
+			dryRun.Env.Added[key] = redactVariable(key, value)
+		case previous != value:
+			if dryRun.Env.Changed == nil {
+				dryRun.Env.Changed = map[string]string{}
+			}
+			dryRun.Env.Changed[key] = redactVariable(key, value)
+		}
+	}
+	return dryRun
+}
+
+// redactVariable hides the value of variables that hold secrets.
+// VCAP_SERVICES holds the credentials of the service bindings.
+func redactVariable(key, value string) string {
+	if key == "VCAP_SERVICES" || logging.IsSensitive(key) {
+		return logging.Redacted
+	}
+	return logging.RedactURLCredentials(value)
+}
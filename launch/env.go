@@ -0,0 +1,93 @@
+package launch
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// environment is a list of "key=value" variables in the order of the
+// environment they came from. The first definition of a variable wins, as it
+// does for os.Getenv.
+type environment struct {
+	vars []string
+}
+
+func newEnvironment(vars []string) *environment {
+	return &environment{vars: append([]string{}, vars...)}
+}
+
+func (e *environment) lookup(key string) (string, bool) {
+	for _, kv := range e.vars {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (e *environment) get(key string) string {
+	value, _ := e.lookup(key)
+	return value
+}
+
+func (e *environment) set(key, value string) {
+	for i, kv := range e.vars {
+		if k, _, ok := strings.Cut(kv, "="); ok && k == key {
+			e.vars[i] = key + "=" + value
+			return
+		}
+	}
+	e.vars = append(e.vars, key+"="+value)
+}
+
+func imagePath(imageEnv []string) string {
+	imagePath := ""
+	for _, kv := range imageEnv {
+		if value, found := strings.CutPrefix(kv, "PATH="); found {
+			imagePath = value
+		}
+	}
+	return imagePath
+}
+
+// lookPath resolves file the way exec.LookPath does against path and, failing
+// that, against the PATH declared by the image. Files with a slash are taken
+// relative to workdir, where the app will start.
+func lookPath(file, path, imagePath, workdir string) (string, error) {
+	if strings.Contains(file, "/") {
+		name := file
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(workdir, name)
+		}
+		if err := findExecutable(name); err != nil {
+			return "", &exec.Error{Name: file, Err: err}
+		}
+		return file, nil
+	}
+
+	for _, dirs := range []string{path, imagePath} {
+		for _, dir := range filepath.SplitList(dirs) {
+			if !filepath.IsAbs(dir) {
+				continue
+			}
+			if resolved := filepath.Join(dir, file); findExecutable(resolved) == nil {
+				return resolved, nil
+			}
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func findExecutable(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fs.ErrPermission
+	}
+	return nil
+}
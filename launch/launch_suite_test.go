@@ -0,0 +1,13 @@
+package launch_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLaunch(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Docker-App-Lifecycle-Launch Suite")
+}
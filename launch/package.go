@@ -0,0 +1 @@
+package launch // import "code.cloudfoundry.org/dockerapplifecycle/launch"
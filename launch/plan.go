@@ -0,0 +1,258 @@
+package launch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/databaseuri"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+	"code.cloudfoundry.org/dockerapplifecycle/protocol"
+)
+
+// LaunchPlan is the process that runs an app: the argv to exec, its
+// environment, the directory it starts in and the user it runs as. User is
+// nil when the app keeps the identity of the launcher. StopSignal is the
+// STOPSIGNAL of the image as declared; only a supervising launcher needs it,
+// so it is left to ParseSignal.
+type LaunchPlan struct {
+	Argv       []string `json:"argv"`
+	Env        []string `json:"env"`
+	Workdir    string   `json:"workdir"`
+	User       *User    `json:"user,omitempty"`
+	StopSignal string   `json:"stop_signal,omitempty"`
+}
+
+// Inputs are what a LaunchPlan is built from.
+type Inputs struct {
+	// StartCommand is the custom start command of the app. The entrypoint and
+	// command of the image run when it is empty.
+	StartCommand string
+	// Metadata is the execution metadata recorded by the builder as JSON.
+	Metadata string
+	// Env is the environment of the launcher in "key=value" form.
+	Env []string
+	// NewCredHub creates the client that interpolates the credhub-ref entries
+	// of VCAP_SERVICES. It defaults to NewCredHub.
+	NewCredHub CredHubFactory
+	// SkipInterpolation leaves the credhub-ref entries of VCAP_SERVICES as
+	// they are, so that planning makes no requests to CredHub.
+	SkipInterpolation bool
+	// Privileged is set when the launcher runs as root, the only case in
+	// which the app can switch to the USER of the image.
+	Privileged bool
+	// Root is where the /etc/passwd and /etc/group files of the image are
+	// looked up. It defaults to "/".
+	Root   string
+	Logger logging.EventLogger
+}
+
+// Error is returned when no launch plan can be built. ExitCode is the exit
+// status of the launcher for the failure.
+type Error struct {
+	ExitCode int
+	Phase    logging.Phase
+	Message  string
+	Data     logging.Data
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Plan builds the launch plan of an app. It neither changes the environment
+// nor the working directory of the caller; the only outside effects are the
+// lookup of the executable and, unless SkipInterpolation is set, the CredHub
+// interpolation of VCAP_SERVICES.
+func Plan(inputs Inputs) (LaunchPlan, error) {
+	logger := inputs.Logger
+	if logger == nil {
+		logger = logging.Discard
+	}
+	newCredHub := inputs.NewCredHub
+	if newCredHub == nil {
+		newCredHub = NewCredHub
+	}
+	env := newEnvironment(inputs.Env)
+
+	platformOptions, err := platformOptions(env)
+	if err != nil {
+		return LaunchPlan{}, &Error{ExitCode: 3, Phase: logging.PhaseCredhub, Message: "Invalid platform options"}
+	}
+
+	if !inputs.SkipInterpolation {
+		err = interpolateVCAPServices(env, platformOptions, newCredHub)
+		if err != nil {
+			return LaunchPlan{}, err
+		}
+	}
+	setDatabaseURL(env, logger)
+	mungeVCAPApplication(env)
+
+	var executionMetadata protocol.ExecutionMetadata
+	err = json.Unmarshal([]byte(inputs.Metadata), &executionMetadata)
+	if err != nil {
+		return LaunchPlan{}, &Error{ExitCode: 1, Phase: logging.PhaseExec, Message: fmt.Sprintf("Invalid metadata - %s", err)}
+	}
+
+	applyImageEnv(env, executionMetadata.Env)
+
+	root := inputs.Root
+	if root == "" {
+		root = "/"
+	}
+
+	var user *User
+	if inputs.Privileged && executionMetadata.User != "" {
+		var home string
+		user, home, err = resolveUser(executionMetadata.User, root)
+		if err != nil {
+			return LaunchPlan{}, &Error{
+				ExitCode: 1,
+				Phase:    logging.PhaseExec,
+				Message:  fmt.Sprintf("Unable to resolve user %s: %s", executionMetadata.User, err),
+				Data:     logging.Data{"user": executionMetadata.User},
+			}
+		}
+		// as with docker, HOME given by the platform or the image wins
+		if _, set := env.lookup("HOME"); !set {
+			env.set("HOME", home)
+		}
+	}
+
+	workdir := "/"
+	if executionMetadata.Workdir != "" {
+		workdir = executionMetadata.Workdir
+	}
+
+	if len(executionMetadata.Entrypoint) == 0 && len(executionMetadata.Cmd) == 0 && inputs.StartCommand == "" {
+		return LaunchPlan{}, &Error{ExitCode: 1, Phase: logging.PhaseExec, Message: "No start command found or specified"}
+	}
+
+	// https://docs.docker.com/reference/builder/#entrypoint and
+	// https://docs.docker.com/reference/builder/#cmd dictate how Entrypoint
+	// and Cmd are treated by docker; we follow these rules here
+	var argv []string
+	if inputs.StartCommand != "" {
+		argv, err = startCommandArgv(inputs.StartCommand, env, root)
+		if err != nil {
+			return LaunchPlan{}, &Error{ExitCode: 1, Phase: logging.PhaseExec, Message: fmt.Sprintf("Invalid start command: %s", err)}
+		}
+	} else {
+		argv = append(append([]string{}, executionMetadata.Entrypoint...), executionMetadata.Cmd...)
+	}
+
+	if argv[0] != shell {
+		argv[0], err = lookPath(argv[0], env.get("PATH"), imagePath(executionMetadata.Env), workdir)
+		if err != nil {
+			return LaunchPlan{}, &Error{
+				ExitCode: 1,
+				Phase:    logging.PhaseExec,
+				Message:  fmt.Sprintf("Failed to resolve path: %s", err),
+				Data:     logging.Data{"executable": argv[0]},
+			}
+		}
+	}
+
+	return LaunchPlan{Argv: argv, Env: env.vars, Workdir: workdir, User: user, StopSignal: executionMetadata.StopSignal}, nil
+}
+
+const shell = "/bin/sh"
+
+// startCommandArgv turns the custom start command of an app into an argv. A
+// JSON array of strings is the argv itself, as with the exec form of CMD. Any
+// other command runs through /bin/sh -c or, in images without a shell, is
+// split into words the way the shell would.
+func startCommandArgv(startCommand string, env *environment, root string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(startCommand), "[") {
+		var argv []string
+		// commands such as `[ -f config ] && ./app` are not JSON and take
+		// the shell path
+		if json.Unmarshal([]byte(startCommand), &argv) == nil {
+			if len(argv) == 0 || argv[0] == "" {
+				return nil, errors.New("the argv is empty")
+			}
+			return argv, nil
+		}
+	}
+
+	if findExecutable(filepath.Join(root, shell)) == nil {
+		return []string{shell, "-c", startCommand}, nil
+	}
+
+	argv, err := splitWords(startCommand, env)
+	if err != nil {
+		return nil, fmt.Errorf("%s and the image has no %s", err, shell)
+	}
+	if len(argv) == 0 {
+		return nil, errors.New("the command has no words")
+	}
+	return argv, nil
+}
+
+// mungeVCAPApplication points VCAP_APPLICATION at the instance the app runs
+// as. A VCAP_APPLICATION that is not a JSON object is left alone.
+func mungeVCAPApplication(env *environment) {
+	vcapAppEnv := map[string]interface{}{}
+	err := json.Unmarshal([]byte(env.get("VCAP_APPLICATION")), &vcapAppEnv)
+	if err != nil {
+		return
+	}
+
+	vcapAppEnv["host"] = "0.0.0.0"
+
+	vcapAppEnv["instance_id"] = env.get("INSTANCE_GUID")
+
+	port, err := strconv.Atoi(env.get("PORT"))
+	if err == nil {
+		vcapAppEnv["port"] = port
+	}
+
+	index, err := strconv.Atoi(env.get("INSTANCE_INDEX"))
+	if err == nil {
+		vcapAppEnv["instance_index"] = index
+	}
+
+	mungedAppEnv, err := json.Marshal(vcapAppEnv)
+	if err == nil {
+		env.set("VCAP_APPLICATION", string(mungedAppEnv))
+	}
+}
+
+// applyImageEnv sets the variables declared by the image's ENV instructions.
+// As with `docker run -e`, variables provided by the platform take precedence
+// over the image defaults.
+func applyImageEnv(env *environment, imageEnv []string) {
+	for _, kv := range imageEnv {
+		key, value, found := strings.Cut(kv, "=")
+		if !found || key == "" {
+			continue
+		}
+		if _, set := env.lookup(key); set {
+			continue
+		}
+		env.set(key, value)
+	}
+}
+
+func setDatabaseURL(env *environment, logger logging.EventLogger) {
+	vcapServices := env.get("VCAP_SERVICES")
+	if vcapServices == "" {
+		return
+	}
+
+	databaseURI := databaseuri.New()
+	creds, err := databaseURI.Credentials([]byte(vcapServices))
+	if err != nil {
+		logger.Warn(logging.PhaseExec, fmt.Sprintf("Cannot parse vcap services: %s", err))
+		return
+	}
+	uri := databaseURI.Uri(creds)
+	if uri == "" {
+		return
+	}
+	env.set("DATABASE_URL", uri)
+}
@@ -0,0 +1,155 @@
+package launch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// splitWords splits command into the words /bin/sh would run it with, for
+// images without a shell. Quotes and backslashes are removed, and $NAME and
+// ${NAME} outside single quotes are expanded from env; the expanded values
+// are not split any further. Anything else, such as pipes, redirections,
+// lists, command substitution, globs, tildes or variable assignments before
+// the command, needs a shell and is rejected.
+func splitWords(command string, env *environment) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+		// plain is set while the word holds only unquoted literal characters
+		plain = true
+	)
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		if strings.IndexByte("'\"\\$", c) >= 0 {
+			plain = false
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			plain = true
+		case c == '#' && !inWord:
+			i = len(command)
+		case c == '~' && !inWord:
+			return nil, fmt.Errorf("%q needs a shell", c)
+		case c == '=' && len(words) == 0 && plain && isName(word.String()):
+			return nil, fmt.Errorf("variable assignment %q needs a shell", word.String()+"=")
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			for i++; i < len(command) && command[i] != '"'; i++ {
+				switch command[i] {
+				case '\\':
+					if i+1 < len(command) && strings.IndexByte("$`\"\\\n", command[i+1]) >= 0 {
+						i++
+						if command[i] != '\n' {
+							word.WriteByte(command[i])
+						}
+					} else {
+						word.WriteByte('\\')
+					}
+				case '$':
+					value, n, err := expand(command[i:], env)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(value)
+					i += n - 1
+				case '`':
+					return nil, errors.New("command substitution needs a shell")
+				default:
+					word.WriteByte(command[i])
+				}
+			}
+			if i >= len(command) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 < len(command) {
+				i++
+				if command[i] == '\n' {
+					continue
+				}
+			}
+			word.WriteByte(command[i])
+			inWord = true
+		case c == '$':
+			value, n, err := expand(command[i:], env)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			i += n - 1
+			// as in sh, an unquoted expansion to nothing is no word at all
+			inWord = inWord || value != ""
+		case strings.IndexByte("|&;<>()`*?[", c) >= 0:
+			return nil, fmt.Errorf("%q needs a shell", c)
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expand expands the parameter at the start of s, which starts with a $, and
+// returns its value and the length of the expression. A $ that starts no
+// parameter is kept.
+func expand(s string, env *environment) (string, int, error) {
+	if strings.HasPrefix(s, "${") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", 0, errors.New("unterminated parameter expansion")
+		}
+		name := s[2:end]
+		if !isName(name) {
+			return "", 0, fmt.Errorf("%q needs a shell", s[:end+1])
+		}
+		return env.get(name), end + 1, nil
+	}
+
+	n := 1
+	for n < len(s) && isNameByte(s[n], n == 1) {
+		n++
+	}
+	if n > 1 {
+		return env.get(s[1:n]), n, nil
+	}
+	if len(s) > 1 && strings.IndexByte("(0123456789@*#?-$!", s[1]) >= 0 {
+		return "", 0, fmt.Errorf("%q needs a shell", s[:2])
+	}
+	return "$", 1, nil
+}
+
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameByte(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
@@ -0,0 +1,81 @@
+package launch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The real-time signals as seen by glibc programs, which reserve the first
+// two of the kernel. Docker numbers them the same way.
+const (
+	sigrtmin = 34
+	sigrtmax = 64
+)
+
+// ParseSignal parses the STOPSIGNAL of an image, either a number or a name
+// with or without the SIG prefix, such as SIGQUIT, QUIT or 3. Real-time
+// signals can be named relative to SIGRTMIN or SIGRTMAX, as in SIGRTMIN+3.
+// Without a STOPSIGNAL apps are stopped with SIGTERM.
+func ParseSignal(s string) (syscall.Signal, error) {
+	if s == "" {
+		return syscall.SIGTERM, nil
+	}
+
+	if number, err := strconv.Atoi(s); err == nil {
+		if number <= 0 || number > sigrtmax || (number < sigrtmin && unix.SignalName(syscall.Signal(number)) == "") {
+			return 0, fmt.Errorf("unknown signal %s", s)
+		}
+		return syscall.Signal(number), nil
+	}
+
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if signal, ok := parseRealTimeSignal(name); ok {
+		return signal, nil
+	}
+	signal := unix.SignalNum(name)
+	if signal == 0 {
+		return 0, fmt.Errorf("unknown signal %s", s)
+	}
+	return signal, nil
+}
+
+// parseRealTimeSignal parses SIGRTMIN, SIGRTMAX, SIGRTMIN+n and SIGRTMAX-n.
+func parseRealTimeSignal(name string) (syscall.Signal, bool) {
+	var base, sign int
+	var offset string
+	switch {
+	case strings.HasPrefix(name, "SIGRTMIN"):
+		base, sign, offset = sigrtmin, 1, strings.TrimPrefix(name, "SIGRTMIN")
+		if offset != "" && !strings.HasPrefix(offset, "+") {
+			return 0, false
+		}
+	case strings.HasPrefix(name, "SIGRTMAX"):
+		base, sign, offset = sigrtmax, -1, strings.TrimPrefix(name, "SIGRTMAX")
+		if offset != "" && !strings.HasPrefix(offset, "-") {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	n := 0
+	if offset != "" {
+		var err error
+		n, err = strconv.Atoi(offset[1:])
+		if err != nil || n < 0 {
+			return 0, false
+		}
+	}
+	number := base + sign*n
+	if number < sigrtmin || number > sigrtmax {
+		return 0, false
+	}
+	return syscall.Signal(number), true
+}
@@ -0,0 +1,188 @@
+package launch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// User is the identity the app runs as when the image declares a USER.
+type User struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups,omitempty"`
+}
+
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// resolveUser resolves the USER of an image, one of user, uid, user:group or
+// uid:gid, against the /etc/passwd and /etc/group files under root. As with
+// docker, numeric ids need no entry, the primary group defaults to the one of
+// the user and a user without an entry gets gid 0 and the home directory "/".
+// Unless the group is given, the user also joins the groups that list it as
+// a member.
+func resolveUser(spec, root string) (*User, string, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" || (hasGroup && groupPart == "") {
+		return nil, "", fmt.Errorf("invalid user %q", spec)
+	}
+
+	passwd, err := readPasswd(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &User{}
+	home := "/"
+	name := ""
+	if entry, ok := findPasswdEntry(passwd, userPart); ok {
+		user.UID, user.GID, home, name = entry.uid, entry.gid, entry.home, entry.name
+	} else if uid, err := parseID(userPart); err == nil {
+		user.UID = uid
+	} else {
+		return nil, "", fmt.Errorf("no user %q in /etc/passwd", userPart)
+	}
+	if home == "" {
+		home = "/"
+	}
+
+	groups, err := readGroup(filepath.Join(root, "etc", "group"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if hasGroup {
+		if entry, ok := findGroupEntry(groups, groupPart); ok {
+			user.GID = entry.gid
+		} else if gid, err := parseID(groupPart); err == nil {
+			user.GID = gid
+		} else {
+			return nil, "", fmt.Errorf("no group %q in /etc/group", groupPart)
+		}
+		user.Groups = []uint32{user.GID}
+		return user, home, nil
+	}
+
+	user.Groups = []uint32{user.GID}
+	if name == "" {
+		return user, home, nil
+	}
+	for _, group := range groups {
+		if group.gid == user.GID {
+			continue
+		}
+		for _, member := range group.members {
+			if member == name {
+				user.Groups = append(user.Groups, group.gid)
+				break
+			}
+		}
+	}
+	return user, home, nil
+}
+
+func findPasswdEntry(entries []passwdEntry, userPart string) (passwdEntry, bool) {
+	for _, entry := range entries {
+		if entry.name == userPart {
+			return entry, true
+		}
+	}
+	if uid, err := parseID(userPart); err == nil {
+		for _, entry := range entries {
+			if entry.uid == uid {
+				return entry, true
+			}
+		}
+	}
+	return passwdEntry{}, false
+}
+
+func findGroupEntry(entries []groupEntry, groupPart string) (groupEntry, bool) {
+	for _, entry := range entries {
+		if entry.name == groupPart {
+			return entry, true
+		}
+	}
+	return groupEntry{}, false
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// readPasswd parses the entries of a passwd file. A missing file has no
+// entries; malformed lines are skipped.
+func readPasswd(path string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := readColonFile(path, func(fields []string) {
+		if len(fields) < 6 {
+			return
+		}
+		uid, uidErr := parseID(fields[2])
+		gid, gidErr := parseID(fields[3])
+		if uidErr != nil || gidErr != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	})
+	return entries, err
+}
+
+// readGroup parses the entries of a group file. A missing file has no
+// entries; malformed lines are skipped.
+func readGroup(path string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := readColonFile(path, func(fields []string) {
+		if len(fields) < 4 {
+			return
+		}
+		gid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	})
+	return entries, err
+}
+
+func readColonFile(path string, parse func(fields []string)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parse(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
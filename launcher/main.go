@@ -1,237 +1,149 @@
 package main
 
 import (
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/url"
 	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
 	"runtime"
 	"strconv"
-	"strings"
 	"syscall"
 
-	"code.cloudfoundry.org/credhub-cli/credhub"
-
-	"code.cloudfoundry.org/buildpackapplifecycle/databaseuri"
-	"code.cloudfoundry.org/dockerapplifecycle/protocol"
+	"code.cloudfoundry.org/dockerapplifecycle/launch"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
 )
 
-type PlatformOptions struct {
-	CredhubURI string `json:"credhub-uri"`
-}
-
 const (
-	PlatformOptionsEnvVar  = "VCAP_PLATFORM_OPTIONS"
-	CFSystemCertPathEnvVar = "CF_SYSTEM_CERT_PATH"
+	LogFormatEnvVar = "CF_LAUNCHER_LOG_FORMAT"
+	DryRunEnvVar    = "CF_LAUNCHER_DRY_RUN"
+	SuperviseEnvVar = "CF_LAUNCHER_SUPERVISE"
+	dryRunFlag      = "--dry-run"
+	superviseFlag   = "--supervise"
 )
 
-func main() {
-	if len(os.Args) < 4 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <ignored> <start command> <metadata>\n", os.Args[0])
-		os.Exit(1)
-	}
-
-	// os.Args[1] is ignored, but left for backwards compatibility
-	startCommand := os.Args[2]
-	metadata := os.Args[3]
+var logger = logging.New(os.Stderr, logging.TextFormat)
 
-	platformOptions, err := platformOptions()
+func main() {
+	format, err := logging.ParseFormat(os.Getenv(LogFormatEnvVar))
+	logger = logging.New(os.Stderr, format)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid platform options\n")
-		os.Exit(3)
-	}
-
-	interpolateVCAPServices(platformOptions)
-	setDatabaseURL()
-
-	vcapAppEnv := map[string]interface{}{}
-
-	err = json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &vcapAppEnv)
-	if err == nil {
-		vcapAppEnv["host"] = "0.0.0.0"
-
-		vcapAppEnv["instance_id"] = os.Getenv("INSTANCE_GUID")
-
-		port, err := strconv.Atoi(os.Getenv("PORT"))
-		if err == nil {
-			vcapAppEnv["port"] = port
-		}
-
-		index, err := strconv.Atoi(os.Getenv("INSTANCE_INDEX"))
-		if err == nil {
-			vcapAppEnv["instance_index"] = index
-		}
-
-		mungedAppEnv, err := json.Marshal(vcapAppEnv)
-		if err == nil {
-			err := os.Setenv("VCAP_APPLICATION", string(mungedAppEnv))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Couldn't set VCAP_APPLICATION env var: %s\n", err)
-				os.Exit(1)
-			}
+		logger.Warn("", err.Error())
+	}
+
+	// a dry run prints the launch plan instead of running it, and a
+	// supervised app runs as a child of the launcher instead of replacing it
+	args := os.Args[1:]
+	dryRun, _ := strconv.ParseBool(os.Getenv(DryRunEnvVar))
+	supervised, _ := strconv.ParseBool(os.Getenv(SuperviseEnvVar))
+flags:
+	for len(args) > 0 {
+		switch args[0] {
+		case dryRunFlag:
+			dryRun = true
+		case superviseFlag:
+			supervised = true
+		default:
+			break flags
 		}
+		args = args[1:]
 	}
 
-	var executionMetadata protocol.ExecutionMetadata
-	err = json.Unmarshal([]byte(metadata), &executionMetadata)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid metadata - %s\n", err)
+	if len(args) < 3 {
+		logger.Error("", fmt.Sprintf("Usage: %s <ignored> <start command> <metadata>", os.Args[0]))
 		os.Exit(1)
 	}
 
-	workdir := "/"
-	if executionMetadata.Workdir != "" {
-		workdir = executionMetadata.Workdir
-	}
-	err = os.Chdir(workdir)
+	// args[0] is ignored, but left for backwards compatibility
+	env := os.Environ()
+	plan, err := launch.Plan(launch.Inputs{
+		StartCommand: args[1],
+		Metadata:     args[2],
+		Env:          env,
+		// a dry run must not reach out to CredHub, nor fail when it cannot
+		SkipInterpolation: dryRun,
+		Privileged:        os.Getuid() == 0,
+		Logger:            logger,
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't change directories to %s: %s\n", workdir, err)
-		os.Exit(1)
-	}
-
-	if len(executionMetadata.Entrypoint) == 0 && len(executionMetadata.Cmd) == 0 && startCommand == "" {
-		fmt.Fprintf(os.Stderr, "No start command found or specified\n")
-		os.Exit(1)
+		fail(err)
 	}
 
-	// https://docs.docker.com/reference/builder/#entrypoint and
-	// https://docs.docker.com/reference/builder/#cmd dictate how Entrypoint
-	// and Cmd are treated by docker; we follow these rules here
-	var argv []string
-	if startCommand != "" {
-		argv = []string{"/bin/sh", "-c", startCommand}
-	} else {
-		argv = append(executionMetadata.Entrypoint, executionMetadata.Cmd...)
-		argv[0], err = exec.LookPath(argv[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to resolve path: %s\n", err)
+	if dryRun {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan.DryRun(env)); err != nil {
+			logger.Error(logging.PhaseExec, fmt.Sprintf("Failed to print the launch plan: %s", err))
 			os.Exit(1)
 		}
-	}
-
-	runtime.GOMAXPROCS(1)
-	err = syscall.Exec(argv[0], argv, os.Environ())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to run: %s\n", err)
-		os.Exit(1)
-	}
-}
-
-func setDatabaseURL() {
-	vcapServices := os.Getenv("VCAP_SERVICES")
-	if vcapServices == "" {
 		return
 	}
 
-	databaseURI := databaseuri.New()
-	creds, err := databaseURI.Credentials([]byte(vcapServices))
+	err = os.Chdir(plan.Workdir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot parse vcap services: %s\n", err)
-		return
-	}
-	uri := databaseURI.Uri(creds)
-	if uri == "" {
-		return
-	}
-	if err := os.Setenv("DATABASE_URL", uri); err != nil {
-		panic(err)
-	}
-}
-
-func interpolateVCAPServices(platformOptions *PlatformOptions) {
-	if platformOptions == nil || platformOptions.CredhubURI == "" {
-		return
-	}
-
-	vcapServices := os.Getenv("VCAP_SERVICES")
-	if !strings.Contains(vcapServices, `"credhub-ref"`) {
-		return
-	}
-
-	certPath := os.Getenv("CF_INSTANCE_CERT")
-	keyPath := os.Getenv("CF_INSTANCE_KEY")
-	rootCAs := rootCAs()
-
-	credhubURI := platformOptions.CredhubURI
-	_, err := url.ParseRequestURI(credhubURI)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid CredHub URI: '%s'\n", credhubURI)
-		os.Exit(4)
+		logger.Error(logging.PhaseExec, fmt.Sprintf("Couldn't change directories to %s: %s", plan.Workdir, err), logging.Data{"workdir": plan.Workdir})
+		os.Exit(1)
 	}
 
-	if certPath == "" || keyPath == "" {
-		fmt.Fprintf(os.Stderr, "Unable to load instance identity credentials; CF_INSTANCE_CERT: '%s', CF_INSTANCE_KEY: '%s'\n", certPath, keyPath)
-		os.Exit(4)
-	}
+	if supervised {
+		stopSignal, err := launch.ParseSignal(plan.StopSignal)
+		if err != nil {
+			logger.Warn(logging.PhaseExec, fmt.Sprintf("Invalid stop signal, stopping the app with SIGTERM instead: %s", err), logging.Data{"stop_signal": plan.StopSignal})
+			stopSignal = syscall.SIGTERM
+		}
 
-	ch, err := credhub.New(credhubURI, credhub.ClientCert(certPath, keyPath), credhub.CaCerts(rootCAs...))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create a credhub client: %s\n", err)
-		os.Exit(4)
+		exitCode, err := supervise(plan, stopSignal)
+		if err != nil {
+			logger.Error(logging.PhaseExec, fmt.Sprintf("Failed to run: %s", err), logging.Data{"executable": plan.Argv[0]})
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
 	}
 
-	interpolatedVcapServices, err := ch.InterpolateString(vcapServices)
-
-	if err != nil {
-		fmt.Fprint(os.Stderr, formatCredHubErrorMessage(err))
-		os.Exit(4)
+	if plan.User != nil {
+		err = dropPrivileges(plan.User)
+		if err != nil {
+			logger.Error(logging.PhaseExec, fmt.Sprintf("Couldn't switch to uid %d: %s", plan.User.UID, err), logging.Data{"uid": plan.User.UID, "gid": plan.User.GID})
+			os.Exit(1)
+		}
 	}
 
-	err = os.Setenv("VCAP_SERVICES", interpolatedVcapServices)
+	runtime.GOMAXPROCS(1)
+	err = syscall.Exec(plan.Argv[0], plan.Argv, plan.Env)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot set environment variable: %s\n", err)
-		os.Exit(4)
+		logger.Error(logging.PhaseExec, fmt.Sprintf("Failed to run: %s", err), logging.Data{"executable": plan.Argv[0]})
+		os.Exit(1)
 	}
 }
 
-func rootCAs() []string {
-	certsPath := os.Getenv(CFSystemCertPathEnvVar)
-	pattern := path.Join(certsPath, "*.crt")
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to locate system certs: %s\n", err)
-		os.Exit(4)
-	}
-	certs := []string{}
-	for _, m := range matches {
-		content, err := os.ReadFile(m)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to read system certs: %s\n", err)
-			os.Exit(4)
-		}
-		certs = append(certs, string(content))
+// dropPrivileges switches every thread of the launcher to user; the
+// supplementary groups and the gid go first, while it is still root.
+func dropPrivileges(user *launch.User) error {
+	groups := make([]int, len(user.Groups))
+	for i, gid := range user.Groups {
+		groups[i] = int(gid)
 	}
-	return certs
-}
-
-func platformOptions() (*PlatformOptions, error) {
-	jsonPlatformOptions := os.Getenv(PlatformOptionsEnvVar)
-	if jsonPlatformOptions == "" {
-		return nil, nil
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
 	}
-	platformOptions := PlatformOptions{}
-	err := json.Unmarshal([]byte(jsonPlatformOptions), &platformOptions)
-	if err != nil {
-		return nil, err
+	if err := syscall.Setgid(int(user.GID)); err != nil {
+		return err
 	}
-
-	return &platformOptions, nil
+	return syscall.Setuid(int(user.UID))
 }
 
-func formatCredHubErrorMessage(err error) string {
-	var unknownAuthErr *x509.UnknownAuthorityError
-	if errors.As(err, &unknownAuthErr) {
-		return fmt.Sprintf("Unable to verify CredHub server: %s", unknownAuthErr)
+// fail logs why no launch plan could be built and exits with the status of
+// the failure.
+func fail(err error) {
+	var launchErr *launch.Error
+	if !errors.As(err, &launchErr) {
+		logger.Error("", err.Error())
+		os.Exit(1)
 	}
 
-	if typeErr, ok := err.(*url.Error); ok {
-		return formatCredHubErrorMessage(typeErr.Err)
+	if launchErr.Data != nil {
+		logger.Error(launchErr.Phase, launchErr.Message, launchErr.Data)
+	} else {
+		logger.Error(launchErr.Phase, launchErr.Message)
 	}
-
-	return fmt.Sprintf("Unable to interpolate credhub references: %s", err)
+	os.Exit(launchErr.ExitCode)
 }
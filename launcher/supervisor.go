@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"code.cloudfoundry.org/dockerapplifecycle/launch"
+)
+
+const prSetChildSubreaper = 36
+
+// supervise runs the launch plan as a child of the launcher, much like tini.
+// The launcher adopts the orphans of the app and reaps them, and forwards
+// the signals it receives to the app, SIGTERM as stopSignal. It returns the
+// exit status of the app, 128 plus the signal number when a signal killed it.
+func supervise(plan launch.LaunchPlan, stopSignal syscall.Signal) (int, error) {
+	// orphans are reparented to PID 1 anyway; a subreaper adopts them when
+	// the launcher runs at another PID
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("failed to become a subreaper: %s", errno)
+	}
+
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	defer signal.Stop(signals)
+
+	attr := &syscall.SysProcAttr{}
+	if plan.User != nil {
+		attr.Credential = &syscall.Credential{Uid: plan.User.UID, Gid: plan.User.GID, Groups: plan.User.Groups}
+	}
+	process, err := os.StartProcess(plan.Argv[0], plan.Argv, &os.ProcAttr{
+		Dir:   plan.Workdir,
+		Env:   plan.Env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   attr,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		// reaping on every signal copes with SIGCHLDs lost to a full channel
+		if status, exited := reap(process.Pid); exited {
+			return exitStatus(status), nil
+		}
+
+		sig := <-signals
+		switch sig {
+		case syscall.SIGCHLD:
+		case syscall.SIGURG:
+			// the Go runtime preempts goroutines with SIGURG
+		case syscall.SIGTERM:
+			process.Signal(stopSignal)
+		default:
+			process.Signal(sig)
+		}
+	}
+}
+
+// reap waits for every exited child of the launcher and reports the status
+// of pid if it is among them.
+func reap(pid int) (syscall.WaitStatus, bool) {
+	var status syscall.WaitStatus
+	exited := false
+	for {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || wpid <= 0 {
+			return status, exited
+		}
+		if wpid == pid {
+			status, exited = ws, true
+		}
+	}
+}
+
+func exitStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
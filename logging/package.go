@@ -0,0 +1 @@
+package logging // import "code.cloudfoundry.org/dockerapplifecycle/logging"
@@ -3,7 +3,12 @@ package dockerapplifecycle
 type ProcessTypes map[string]string
 
 type LifecycleMetadata struct {
-	DockerImage string `json:"docker_image"`
+	DockerImage             string `json:"docker_image"`
+	DockerImageDigest       string `json:"docker_image_digest,omitempty"`
+	DockerImageSize         int64  `json:"docker_image_size,omitempty"`
+	DockerImageLayers       int    `json:"docker_image_layers,omitempty"`
+	DockerImageMediaType    string `json:"docker_image_media_type,omitempty"`
+	DockerImageConfigDigest string `json:"docker_image_config_digest,omitempty"`
 }
 
 type StagingResult struct {
@@ -21,3 +26,36 @@ func NewStagingResult(procTypes ProcessTypes, lifeMeta LifecycleMetadata, execMe
 		ExecutionMetadata: execMeta,
 	}
 }
+
+// Failure codes of a StagingFailure.
+const (
+	FailureStagingFailed       = "STAGING_FAILED"
+	FailureImageNotFound       = "IMAGE_NOT_FOUND"
+	FailureUnauthorized        = "UNAUTHORIZED"
+	FailureRateLimited         = "RATE_LIMITED"
+	FailureRegistryUnavailable = "REGISTRY_UNAVAILABLE"
+	FailureUnsupportedPlatform = "UNSUPPORTED_PLATFORM"
+	FailureTLSError            = "TLS_ERROR"
+	FailureInvalidPorts        = "INVALID_PORTS"
+	FailureSignatureRejected   = "SIGNATURE_REJECTED"
+	FailureCacheFailed         = "CACHE_FAILED"
+	FailureTimeout             = "TIMEOUT"
+	FailureImageTooLarge       = "IMAGE_TOO_LARGE"
+	FailureTooManyLayers       = "TOO_MANY_LAYERS"
+	FailureInvalidProcessTypes = "INVALID_PROCESS_TYPES"
+	FailurePolicyViolation     = "POLICY_VIOLATION"
+	FailureInvalidReference    = "INVALID_REFERENCE"
+	FailureInvalidPlatform     = "INVALID_PLATFORM"
+	FailureInvalidConfig       = "INVALID_CONFIGURATION"
+)
+
+// StagingFailure is written instead of a StagingResult when staging fails, so
+// that the platform can tell users why.
+type StagingFailure struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Registry string `json:"registry,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+}
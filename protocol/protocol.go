@@ -6,11 +6,19 @@ type ExecutionMetadata struct {
 	Workdir      string   `json:"workdir,omitempty"`
 	ExposedPorts []Port   `json:"ports,omitempty"`
 	User         string   `json:"user,omitempty"`
+	Env          []string `json:"env,omitempty"`
+	StopSignal   string   `json:"stop_signal,omitempty"`
 }
 
 type DockerImageMetadata struct {
-	ExecutionMetadata ExecutionMetadata
-	DockerImage       string
+	ExecutionMetadata       ExecutionMetadata
+	DockerImage             string
+	DockerImageDigest       string
+	DockerImageSize         int64
+	DockerImageLayers       int
+	DockerImageMediaType    string
+	DockerImageConfigDigest string
+	ProcessTypes            map[string]string
 }
 
 type Port struct {
@@ -0,0 +1,58 @@
+package staging
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/ecrhelper"
+	"github.com/containers/image/v5/types"
+)
+
+// CredentialProvider returns the credentials for a registry. Empty credentials
+// pull anonymously. *helpers.DockerConfig is a CredentialProvider.
+type CredentialProvider interface {
+	Credentials(registryURL string) (types.DockerAuthConfig, error)
+}
+
+// StaticCredentials are used for every registry.
+type StaticCredentials types.DockerAuthConfig
+
+func (c StaticCredentials) Credentials(registryURL string) (types.DockerAuthConfig, error) {
+	return types.DockerAuthConfig(c), nil
+}
+
+// ECRCredentials exchanges the AWS access key in Username and Password for the
+// credentials of ECR registries. Next is asked for any other registry, and for
+// ECR registries when no access key is given.
+type ECRCredentials struct {
+	Helper   ecrhelper.ECRHelper
+	Username string
+	Password string
+	Next     CredentialProvider
+}
+
+func (c ECRCredentials) Credentials(registryURL string) (types.DockerAuthConfig, error) {
+	isECRRepo, err := c.Helper.IsECRRepo(registryURL)
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf(
+			"failed to check whether the registry URL is ECR repo: %s",
+			err.Error(),
+		)
+	}
+
+	if !isECRRepo || (c.Username == "" && c.Password == "") {
+		if c.Next == nil {
+			return types.DockerAuthConfig{}, nil
+		}
+		return c.Next.Credentials(registryURL)
+	}
+
+	username, password, err := c.Helper.GetECRCredentials(registryURL, c.Username, c.Password)
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf(
+			"failed to get ECR credentials from [%s] due to %s",
+			registryURL,
+			err.Error(),
+		)
+	}
+	return types.DockerAuthConfig{Username: username, Password: password}, nil
+}
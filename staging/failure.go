@@ -0,0 +1,86 @@
+package staging
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/dockerapplifecycle"
+	"code.cloudfoundry.org/dockerapplifecycle/helpers"
+)
+
+// stagingError attaches a failure code to an error whose cause does not tell
+// which step of staging failed.
+type stagingError struct {
+	code string
+	err  error
+}
+
+func (e *stagingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stagingError) Unwrap() error {
+	return e.err
+}
+
+// FailureCode returns the dockerapplifecycle failure code of an error returned
+// by Stage. Errors that cannot be categorized are STAGING_FAILED.
+func FailureCode(err error) string {
+	var staging *stagingError
+	if errors.As(err, &staging) {
+		return staging.code
+	}
+
+	var policyViolation *helpers.PolicyViolationError
+	if errors.As(err, &policyViolation) {
+		return dockerapplifecycle.FailurePolicyViolation
+	}
+
+	var unsupportedPlatform *helpers.UnsupportedPlatformError
+	if errors.As(err, &unsupportedPlatform) {
+		return dockerapplifecycle.FailureUnsupportedPlatform
+	}
+
+	var tooLarge *helpers.ImageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return dockerapplifecycle.FailureImageTooLarge
+	}
+
+	var tooManyLayers *helpers.TooManyLayersError
+	if errors.As(err, &tooManyLayers) {
+		return dockerapplifecycle.FailureTooManyLayers
+	}
+
+	if errors.Is(err, helpers.ErrSignatureRejected) {
+		return dockerapplifecycle.FailureSignatureRejected
+	}
+
+	var registryErr *helpers.RegistryError
+	if errors.As(err, &registryErr) {
+		switch registryErr.Kind {
+		case helpers.NotFoundError:
+			return dockerapplifecycle.FailureImageNotFound
+		case helpers.UnauthorizedError:
+			return dockerapplifecycle.FailureUnauthorized
+		case helpers.RateLimitedError:
+			return dockerapplifecycle.FailureRateLimited
+		case helpers.TLSError:
+			return dockerapplifecycle.FailureTLSError
+		case helpers.TransientError:
+			return dockerapplifecycle.FailureRegistryUnavailable
+		}
+	}
+
+	return dockerapplifecycle.FailureStagingFailed
+}
+
+// Failure returns the failure document for an error of staging ref.
+func Failure(ref helpers.Reference, err error) dockerapplifecycle.StagingFailure {
+	return dockerapplifecycle.StagingFailure{
+		Code:     FailureCode(err),
+		Message:  err.Error(),
+		Registry: ref.RegistryURL,
+		Repo:     ref.RepoName,
+		Tag:      ref.Tag,
+		Digest:   ref.Digest.String(),
+	}
+}
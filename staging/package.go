@@ -0,0 +1,3 @@
+// Programs that import staging are built, and its tests run, with the
+// containers_image_openpgp build tag, like the builder.
+package staging // import "code.cloudfoundry.org/dockerapplifecycle/staging"
@@ -0,0 +1,272 @@
+package staging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/dockerapplifecycle"
+	"code.cloudfoundry.org/dockerapplifecycle/docker/nat"
+	"code.cloudfoundry.org/dockerapplifecycle/helpers"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+	"code.cloudfoundry.org/dockerapplifecycle/protocol"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Options configures the staging of a docker image.
+type Options struct {
+	DockerRef                helpers.Reference
+	InsecureDockerRegistries []string
+	Platform                 v1.Platform
+	Credentials              CredentialProvider
+	DockerCertsDir           string
+	SignaturePolicy          *signature.Policy
+	AdmissionPolicy          *helpers.AdmissionPolicy
+	RetryPolicy              helpers.RetryPolicy
+	Timeout                  time.Duration
+	MaxImageSize             int64
+	MaxLayers                int
+	PinDockerImageDigest     bool
+	CacheDockerImage         bool
+	DockerRegistryIPs        []string
+	DockerRegistryHost       string
+	DockerRegistryPort       int
+	DockerRegistryRequireTLS bool
+	Logger                   logging.EventLogger
+}
+
+// Stage inspects the image referenced by options.DockerRef, caches it in the
+// private docker registry when requested, and returns the staging result.
+// Images on the file system cannot be pulled by the cells, so they must be
+// cached. FailureCode tells why staging failed from the returned error.
+func Stage(ctx context.Context, options Options) (dockerapplifecycle.StagingResult, error) {
+	if options.Logger == nil {
+		options.Logger = logging.Discard
+	}
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	result, err := stage(ctx, options)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return dockerapplifecycle.StagingResult{}, &stagingError{
+			code: dockerapplifecycle.FailureTimeout,
+			err:  fmt.Errorf("staging timed out after %s: %w", options.Timeout, err),
+		}
+	}
+	return result, err
+}
+
+func stage(ctx context.Context, options Options) (dockerapplifecycle.StagingResult, error) {
+	logger := options.Logger
+
+	if options.DockerRef.IsLocal() && !options.CacheDockerImage {
+		return dockerapplifecycle.StagingResult{}, &stagingError{
+			code: dockerapplifecycle.FailureInvalidConfig,
+			err:  fmt.Errorf("image [%s] is on the file system and must be cached in the docker registry to be run", options.DockerRef),
+		}
+	}
+
+	if options.AdmissionPolicy != nil {
+		if err := options.AdmissionPolicy.Check(options.DockerRef); err != nil {
+			return dockerapplifecycle.StagingResult{}, err
+		}
+	}
+
+	authConfig, err := options.credentials()
+	if err != nil {
+		return dockerapplifecycle.StagingResult{}, err
+	}
+	logger.Redact(authConfig.Password, authConfig.IdentityToken)
+	if authConfig.Username != "" {
+		logger.Info(logging.PhaseAuth, fmt.Sprintf("Authenticating to %s as %s", options.DockerRef.RegistryURL, authConfig.Username), logging.Data{
+			"registry": options.DockerRef.RegistryURL,
+			"username": authConfig.Username,
+		})
+	}
+
+	sys := &types.SystemContext{
+		DockerAuthConfig:         &authConfig,
+		OSChoice:                 options.Platform.OS,
+		ArchitectureChoice:       options.Platform.Architecture,
+		VariantChoice:            options.Platform.Variant,
+		DockerPerHostCertDirPath: options.DockerCertsDir,
+	}
+	for _, insecure := range options.InsecureDockerRegistries {
+		if options.DockerRef.RegistryURL == insecure {
+			sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+		}
+	}
+
+	var policyContext *signature.PolicyContext
+	if options.SignaturePolicy != nil {
+		policyContext, err = signature.NewPolicyContext(options.SignaturePolicy)
+		if err != nil {
+			return dockerapplifecycle.StagingResult{}, fmt.Errorf("failed to load signature policy due to %s", err.Error())
+		}
+		defer policyContext.Destroy()
+	}
+
+	imgMetadata, err := helpers.FetchMetadata(ctx, options.DockerRef, sys, policyContext, options.RetryPolicy, logger)
+	if err != nil {
+		return dockerapplifecycle.StagingResult{}, fmt.Errorf(
+			"failed to fetch metadata from [%s] and insecure registries %s due to %w",
+			options.DockerRef,
+			options.InsecureDockerRegistries,
+			err,
+		)
+	}
+
+	if options.MaxImageSize > 0 && imgMetadata.Size == 0 && imgMetadata.Layers > 0 {
+		logger.Warn(logging.PhaseManifest, "The image manifest does not record the layer sizes; the maximum image size cannot be enforced")
+	}
+	err = helpers.CheckImageLimits(imgMetadata, options.MaxImageSize, options.MaxLayers)
+	if err != nil {
+		return dockerapplifecycle.StagingResult{}, fmt.Errorf("image [%s] cannot be staged: %w", options.DockerRef, err)
+	}
+
+	info := protocol.DockerImageMetadata{}
+	info.ExecutionMetadata.Cmd = imgMetadata.Cmd
+	info.ExecutionMetadata.Entrypoint = imgMetadata.Entrypoint
+	info.ExecutionMetadata.Workdir = imgMetadata.WorkingDir
+	info.ExecutionMetadata.User = imgMetadata.User
+	info.ExecutionMetadata.Env = imgMetadata.Env
+	info.ExecutionMetadata.StopSignal = imgMetadata.StopSignal
+	info.ExecutionMetadata.ExposedPorts, err = extractPorts(convertPortsToNatPorts(imgMetadata.ExposedPorts))
+	if err != nil {
+		portDetails := fmt.Sprintf("%v", imgMetadata.ExposedPorts)
+		logger.Error(logging.PhaseConfig, fmt.Sprintf("failed to parse image ports %s %s", portDetails, err.Error()), logging.Data{
+			"ports": portDetails,
+			"error": err.Error(),
+		})
+		return dockerapplifecycle.StagingResult{}, &stagingError{code: dockerapplifecycle.FailureInvalidPorts, err: err}
+	}
+	info.ProcessTypes, err = helpers.ImageProcessTypes(imgMetadata.ImageConfig)
+	if err != nil {
+		return dockerapplifecycle.StagingResult{}, &stagingError{
+			code: dockerapplifecycle.FailureInvalidProcessTypes,
+			err:  fmt.Errorf("invalid process types in the labels of [%s]: %w", options.DockerRef, err),
+		}
+	}
+
+	stagedRef := options.DockerRef
+	stagedDigest := imgMetadata.ManifestDigest
+	if options.CacheDockerImage {
+		stagedRef, stagedDigest, err = cacheDockerImage(ctx, options, sys, policyContext)
+		if err != nil {
+			return dockerapplifecycle.StagingResult{}, &stagingError{
+				code: dockerapplifecycle.FailureCacheFailed,
+				err:  fmt.Errorf("failed to cache docker image [%s] due to %w", options.DockerRef, err),
+			}
+		}
+	}
+	if options.PinDockerImageDigest {
+		stagedRef.Tag = ""
+		stagedRef.Digest = stagedDigest
+	}
+	info.DockerImage = stagedRef.String()
+	info.DockerImageDigest = stagedDigest.String()
+	info.DockerImageSize = imgMetadata.Size
+	info.DockerImageLayers = imgMetadata.Layers
+	info.DockerImageMediaType = imgMetadata.MediaType
+	info.DockerImageConfigDigest = imgMetadata.ConfigDigest.String()
+
+	if err := ctx.Err(); err != nil {
+		return dockerapplifecycle.StagingResult{}, err
+	}
+	return helpers.NewStagingResult(&info)
+}
+
+// credentials returns the credentials for the image registry. Images on the
+// file system need no credentials.
+func (options Options) credentials() (types.DockerAuthConfig, error) {
+	if options.DockerRef.IsLocal() || options.Credentials == nil {
+		return types.DockerAuthConfig{}, nil
+	}
+	return options.Credentials.Credentials(options.DockerRef.RegistryURL)
+}
+
+// cacheDockerImage copies the image into the private docker registry, trying
+// the registry host first and then each of the registry IPs.
+func cacheDockerImage(ctx context.Context, options Options, srcCtx *types.SystemContext, policyContext *signature.PolicyContext) (helpers.Reference, digest.Digest, error) {
+	destCtx := &types.SystemContext{DockerPerHostCertDirPath: options.DockerCertsDir}
+	if !options.DockerRegistryRequireTLS {
+		destCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	addresses := []string{}
+	if options.DockerRegistryHost != "" {
+		addresses = append(addresses, fmt.Sprintf("%s:%d", options.DockerRegistryHost, options.DockerRegistryPort))
+	}
+	for _, ip := range options.DockerRegistryIPs {
+		addresses = append(addresses, fmt.Sprintf("%s:%d", ip, options.DockerRegistryPort))
+	}
+	if len(addresses) == 0 {
+		return helpers.Reference{}, "", errors.New("no docker registry host or IPs configured")
+	}
+
+	var err error
+	for _, address := range addresses {
+		var cachedRef helpers.Reference
+		var manifestDigest digest.Digest
+		cachedRef, manifestDigest, err = helpers.CacheImage(ctx, options.DockerRef, srcCtx, policyContext, address, destCtx, options.Logger)
+		if err == nil {
+			return cachedRef, manifestDigest, nil
+		}
+		if ctx.Err() != nil {
+			return helpers.Reference{}, "", ctx.Err()
+		}
+		options.Logger.Warn(logging.PhaseCache, fmt.Sprintf("Failed caching docker image in %s: %s", address, err), logging.Data{
+			"registry": address,
+			"error":    err.Error(),
+		})
+	}
+	return helpers.Reference{}, "", err
+}
+
+func convertPortsToNatPorts(ports map[string]struct{}) map[nat.Port]struct{} {
+	natPorts := map[nat.Port]struct{}{}
+	for portProto, v := range ports {
+		proto, port := nat.SplitProtoPort(portProto)
+		p := nat.NewPort(proto, port)
+		natPorts[p] = v
+	}
+	return natPorts
+}
+
+func extractPorts(dockerPorts map[nat.Port]struct{}) (exposedPorts []protocol.Port, err error) {
+	// sorting panics on ports that do not parse, so they are rejected first
+	for port := range dockerPorts {
+		if _, err := strconv.ParseUint(port.Port(), 10, 16); err != nil {
+			return []protocol.Port{}, err
+		}
+	}
+
+	sortedPorts := sortPorts(dockerPorts)
+	for _, port := range sortedPorts {
+		exposedPort, err := strconv.ParseUint(port.Port(), 10, 16)
+		if err != nil {
+			return []protocol.Port{}, err
+		}
+		exposedPorts = append(exposedPorts, protocol.Port{Port: uint16(exposedPort), Protocol: port.Proto()})
+	}
+	return exposedPorts, nil
+}
+
+func sortPorts(dockerPorts map[nat.Port]struct{}) []nat.Port {
+	var dockerPortsSlice []nat.Port
+	for port := range dockerPorts {
+		dockerPortsSlice = append(dockerPortsSlice, port)
+	}
+	nat.Sort(dockerPortsSlice, func(ip, jp nat.Port) bool {
+		return ip.Int() < jp.Int() || (ip.Int() == jp.Int() && ip.Proto() == "tcp")
+	})
+	return dockerPortsSlice
+}
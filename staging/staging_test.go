@@ -0,0 +1,257 @@
+package staging_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/dockerapplifecycle"
+	"code.cloudfoundry.org/dockerapplifecycle/helpers"
+	"code.cloudfoundry.org/dockerapplifecycle/logging"
+	"code.cloudfoundry.org/dockerapplifecycle/staging"
+	"code.cloudfoundry.org/dockerapplifecycle/testhelpers"
+	"github.com/containers/image/v5/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type fakeECRHelper struct {
+	isECRRepo bool
+	err       error
+}
+
+func (h fakeECRHelper) IsECRRepo(ref string) (bool, error) {
+	return h.isECRRepo, nil
+}
+
+func (h fakeECRHelper) GetECRCredentials(ref, username, password string) (string, string, error) {
+	return "AWS", "token-for-" + username, h.err
+}
+
+var _ = Describe("Staging", func() {
+	var (
+		layoutDir      string
+		manifestDigest digest.Digest
+		cacheRegistry  *testhelpers.FakeRegistry
+		options        staging.Options
+	)
+
+	BeforeEach(func() {
+		layoutDir = filepath.Join(GinkgoT().TempDir(), "app")
+		var err error
+		manifestDigest, err = testhelpers.WriteOCILayout(layoutDir, "1.0", v1.Image{
+			Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+			Config: v1.ImageConfig{
+				Entrypoint:   []string{"/dockerapp"},
+				Cmd:          []string{"-foo"},
+				ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+			},
+			RootFS: v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		ref, err := helpers.ParseDockerRef("oci:" + layoutDir + ":1.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		cacheRegistry = testhelpers.NewFakeRegistry()
+		host, port, err := net.SplitHostPort(cacheRegistry.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		registryPort, err := strconv.Atoi(port)
+		Expect(err).NotTo(HaveOccurred())
+
+		options = staging.Options{
+			DockerRef:          ref,
+			Platform:           v1.Platform{OS: "linux", Architecture: "amd64"},
+			RetryPolicy:        helpers.RetryPolicy{MaxAttempts: 1},
+			CacheDockerImage:   true,
+			DockerRegistryHost: host,
+			DockerRegistryPort: registryPort,
+			Logger:             logging.New(GinkgoWriter, logging.TextFormat),
+		}
+	})
+
+	AfterEach(func() {
+		cacheRegistry.Close()
+	})
+
+	Describe("Stage", func() {
+		It("returns the staging result of the image", func() {
+			result, err := staging.Stage(context.Background(), options)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.LifecycleType).To(Equal("docker"))
+			Expect(result.ProcessTypes).To(Equal(dockerapplifecycle.ProcessTypes{"web": "/dockerapp -foo"}))
+			Expect(result.DockerImage).To(Equal(cacheRegistry.Addr() + "/app:1.0"))
+			Expect(result.DockerImageDigest).To(Equal(manifestDigest.String()))
+			Expect(result.ExecutionMetadata).To(ContainSubstring(`"ports":[{"Port":8080,"Protocol":"tcp"}]`))
+
+			_, ok := cacheRegistry.Manifest("app", "1.0")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("pins the cached image by digest when requested", func() {
+			options.PinDockerImageDigest = true
+
+			result, err := staging.Stage(context.Background(), options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.DockerImage).To(Equal(cacheRegistry.Addr() + "/app@" + manifestDigest.String()))
+			Expect(result.DockerImageDigest).To(Equal(manifestDigest.String()))
+		})
+
+		Context("when the image is not cached", func() {
+			BeforeEach(func() {
+				options.CacheDockerImage = false
+				options.PinDockerImageDigest = true
+			})
+
+			It("fails, as the cells cannot pull images from the file system", func() {
+				_, err := staging.Stage(context.Background(), options)
+				Expect(err).To(MatchError("image [oci:" + layoutDir + ":1.0] is on the file system and must be cached in the docker registry to be run"))
+				Expect(staging.FailureCode(err)).To(Equal(dockerapplifecycle.FailureInvalidConfig))
+			})
+		})
+
+		It("works without a logger", func() {
+			options.Logger = nil
+			_, err := staging.Stage(context.Background(), options)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("does not ask for credentials for images on the file system", func() {
+			options.Credentials = staging.ECRCredentials{Helper: fakeECRHelper{isECRRepo: true, err: errors.New("boom")}}
+			_, err := staging.Stage(context.Background(), options)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("sends the events to the logger", func() {
+			buffer := gbytes.NewBuffer()
+			options.Logger = logging.New(buffer, logging.JSONFormat)
+			options.DockerRef.Path = filepath.Join(filepath.Dir(layoutDir), "missing") + ":1.0"
+
+			_, err := staging.Stage(context.Background(), options)
+			Expect(err).To(HaveOccurred())
+			Expect(buffer).To(gbytes.Say(`"level":"error","phase":"manifest"`))
+		})
+
+		Context("when the image is rejected by the admission policy", func() {
+			BeforeEach(func() {
+				options.AdmissionPolicy = &helpers.AdmissionPolicy{Deny: []string{"oci:**"}}
+			})
+
+			It("fails with the policy violation code", func() {
+				_, err := staging.Stage(context.Background(), options)
+				Expect(err).To(MatchError(ContainSubstring("denied by [oci:**]")))
+				Expect(staging.FailureCode(err)).To(Equal(dockerapplifecycle.FailurePolicyViolation))
+			})
+		})
+
+		Context("when the registry does not answer in time", func() {
+			var server *httptest.Server
+
+			BeforeEach(func() {
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					select {
+					case <-req.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+				}))
+				serverURL, err := url.Parse(server.URL)
+				Expect(err).NotTo(HaveOccurred())
+
+				options.DockerRef = helpers.Reference{RegistryURL: serverURL.Host, RepoName: "some-repo", Tag: "latest"}
+				options.InsecureDockerRegistries = []string{serverURL.Host}
+				options.CacheDockerImage = false
+				options.Timeout = 100 * time.Millisecond
+			})
+
+			AfterEach(func() {
+				server.CloseClientConnections()
+				server.Close()
+			})
+
+			It("fails with the timeout code", func() {
+				_, err := staging.Stage(context.Background(), options)
+				Expect(err).To(MatchError(ContainSubstring("staging timed out after 100ms")))
+				Expect(staging.FailureCode(err)).To(Equal(dockerapplifecycle.FailureTimeout))
+			})
+		})
+	})
+
+	Describe("ECRCredentials", func() {
+		It("exchanges the access key for ECR registries", func() {
+			credentials := staging.ECRCredentials{Helper: fakeECRHelper{isECRRepo: true}, Username: "key-id", Password: "secret"}
+			authConfig, err := credentials.Credentials("123.dkr.ecr.us-east-1.amazonaws.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(authConfig).To(Equal(types.DockerAuthConfig{Username: "AWS", Password: "token-for-key-id"}))
+		})
+
+		It("asks the next provider for other registries", func() {
+			credentials := staging.ECRCredentials{
+				Helper: fakeECRHelper{},
+				Next:   staging.StaticCredentials{Username: "user", Password: "password"},
+			}
+			authConfig, err := credentials.Credentials("registry.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(authConfig).To(Equal(types.DockerAuthConfig{Username: "user", Password: "password"}))
+		})
+
+		It("asks the next provider for ECR registries without an access key", func() {
+			configPath := filepath.Join(GinkgoT().TempDir(), "config.json")
+			Expect(os.WriteFile(configPath, []byte(`{"auths":{"123.dkr.ecr.us-east-1.amazonaws.com":{"username":"AWS","password":"from-config"}}}`), 0600)).To(Succeed())
+			dockerConfig, err := helpers.LoadDockerConfig(configPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			credentials := staging.ECRCredentials{
+				Helper: fakeECRHelper{isECRRepo: true, err: errors.New("should not be exchanged")},
+				Next:   dockerConfig,
+			}
+			authConfig, err := credentials.Credentials("123.dkr.ecr.us-east-1.amazonaws.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(authConfig).To(Equal(types.DockerAuthConfig{Username: "AWS", Password: "from-config"}))
+		})
+
+		It("describes ECR failures", func() {
+			credentials := staging.ECRCredentials{Helper: fakeECRHelper{isECRRepo: true, err: errors.New("boom")}, Username: "key-id", Password: "secret"}
+			_, err := credentials.Credentials("123.dkr.ecr.us-east-1.amazonaws.com")
+			Expect(err).To(MatchError("failed to get ECR credentials from [123.dkr.ecr.us-east-1.amazonaws.com] due to boom"))
+		})
+	})
+
+	Describe("FailureCode", func() {
+		DescribeTable("maps errors to failure codes",
+			func(err error, code string) {
+				Expect(staging.FailureCode(fmt.Errorf("wrapped: %w", err))).To(Equal(code))
+			},
+			Entry("unknown errors", errors.New("boom"), dockerapplifecycle.FailureStagingFailed),
+			Entry("missing images", &helpers.RegistryError{Kind: helpers.NotFoundError}, dockerapplifecycle.FailureImageNotFound),
+			Entry("rejected credentials", &helpers.RegistryError{Kind: helpers.UnauthorizedError}, dockerapplifecycle.FailureUnauthorized),
+			Entry("rate limits", &helpers.RegistryError{Kind: helpers.RateLimitedError}, dockerapplifecycle.FailureRateLimited),
+			Entry("transient registry errors", &helpers.RegistryError{Kind: helpers.TransientError}, dockerapplifecycle.FailureRegistryUnavailable),
+			Entry("signature rejections", helpers.ErrSignatureRejected, dockerapplifecycle.FailureSignatureRejected),
+			Entry("large images", &helpers.ImageTooLargeError{}, dockerapplifecycle.FailureImageTooLarge),
+		)
+
+		It("builds the failure document of a reference", func() {
+			ref := helpers.Reference{RegistryURL: "registry.example.com", RepoName: "app", Tag: "1.0"}
+			failure := staging.Failure(ref, &helpers.RegistryError{Kind: helpers.NotFoundError, Attempts: 1, Err: errors.New("manifest unknown")})
+			Expect(failure).To(Equal(dockerapplifecycle.StagingFailure{
+				Code:     dockerapplifecycle.FailureImageNotFound,
+				Message:  "manifest unknown (not found after 1 attempt)",
+				Registry: "registry.example.com",
+				Repo:     "app",
+				Tag:      "1.0",
+			}))
+		})
+	})
+})
@@ -0,0 +1,290 @@
+package testhelpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FakeManifest is a manifest stored in a FakeRegistry.
+type FakeManifest struct {
+	MediaType string
+	Content   []byte
+}
+
+// FakeRegistry is an in-memory stand-in for a docker registry that supports
+// pulling and pushing images through the v2 API.
+type FakeRegistry struct {
+	server *httptest.Server
+
+	mutex     sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string]FakeManifest
+	uploads   map[string][]byte
+	uploadID  int
+}
+
+// NewFakeRegistry starts an empty FakeRegistry.
+func NewFakeRegistry() *FakeRegistry {
+	registry := &FakeRegistry{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]FakeManifest{},
+		uploads:   map[string][]byte{},
+	}
+	registry.server = httptest.NewServer(registry)
+	return registry
+}
+
+// Close stops the registry.
+func (r *FakeRegistry) Close() {
+	r.server.Close()
+}
+
+// Addr returns the host and port of the registry.
+func (r *FakeRegistry) Addr() string {
+	return r.server.Listener.Addr().String()
+}
+
+// AddImage stores a single-platform OCI image and returns its manifest digest.
+func (r *FakeRegistry) AddImage(repoName, tag string, config v1.Image, layers ...[]byte) (digest.Digest, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	configDigest := digest.FromBytes(configBytes)
+	r.blobs[configDigest] = configBytes
+
+	layerDescriptors := []v1.Descriptor{}
+	for _, layer := range layers {
+		layerDigest := digest.FromBytes(layer)
+		r.blobs[layerDigest] = layer
+		layerDescriptors = append(layerDescriptors, v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      int64(len(layer)),
+		})
+	}
+
+	manifestBytes, err := json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(configBytes)),
+		},
+		Layers: layerDescriptors,
+	})
+	if err != nil {
+		return "", err
+	}
+	manifestDigest := digest.FromBytes(manifestBytes)
+
+	stored := FakeManifest{MediaType: v1.MediaTypeImageManifest, Content: manifestBytes}
+	r.manifests[repoName+":"+tag] = stored
+	r.manifests[repoName+"@"+manifestDigest.String()] = stored
+	return manifestDigest, nil
+}
+
+// AddIndex stores an OCI image index of images added with AddImage, each
+// for the platform of its config, and returns the digest of the index.
+func (r *FakeRegistry) AddIndex(repoName, tag string, images ...digest.Digest) (digest.Digest, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	descriptors := []v1.Descriptor{}
+	for _, image := range images {
+		stored, ok := r.manifests[repoName+"@"+image.String()]
+		if !ok {
+			return "", fmt.Errorf("no image %s@%s", repoName, image)
+		}
+
+		var manifest v1.Manifest
+		if err := json.Unmarshal(stored.Content, &manifest); err != nil {
+			return "", err
+		}
+		var config v1.Image
+		if err := json.Unmarshal(r.blobs[manifest.Config.Digest], &config); err != nil {
+			return "", err
+		}
+
+		platform := config.Platform
+		descriptors = append(descriptors, v1.Descriptor{
+			MediaType: stored.MediaType,
+			Digest:    image,
+			Size:      int64(len(stored.Content)),
+			Platform:  &platform,
+		})
+	}
+
+	indexBytes, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: descriptors,
+	})
+	if err != nil {
+		return "", err
+	}
+	indexDigest := digest.FromBytes(indexBytes)
+
+	stored := FakeManifest{MediaType: v1.MediaTypeImageIndex, Content: indexBytes}
+	r.manifests[repoName+":"+tag] = stored
+	r.manifests[repoName+"@"+indexDigest.String()] = stored
+	return indexDigest, nil
+}
+
+// Manifest returns the manifest stored under a tag or digest.
+func (r *FakeRegistry) Manifest(repoName, reference string) (FakeManifest, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	separator := ":"
+	if strings.Contains(reference, ":") {
+		separator = "@"
+	}
+	stored, ok := r.manifests[repoName+separator+reference]
+	return stored, ok
+}
+
+// HasBlob reports whether the registry stores the blob.
+func (r *FakeRegistry) HasBlob(blobDigest digest.Digest) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.blobs[blobDigest]
+	return ok
+}
+
+func (r *FakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	path := req.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req)
+	case strings.Contains(path, "/blobs/"):
+		r.serveBlob(w, req)
+	case strings.Contains(path, "/manifests/"):
+		r.serveManifest(w, req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *FakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request) {
+	prefix, id, _ := strings.Cut(req.URL.Path, "/blobs/uploads/")
+
+	switch req.Method {
+	case http.MethodPost:
+		r.uploadID++
+		id = fmt.Sprintf("upload-%d", r.uploadID)
+		r.uploads[id] = []byte{}
+		w.Header().Set("Location", prefix+"/blobs/uploads/"+id)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch, http.MethodPut:
+		data, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data = append(data, body...)
+		r.uploads[id] = data
+
+		if req.Method == http.MethodPatch {
+			w.Header().Set("Location", prefix+"/blobs/uploads/"+id)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		blobDigest := digest.Digest(req.URL.Query().Get("digest"))
+		if blobDigest != digest.FromBytes(data) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[blobDigest] = data
+		w.Header().Set("Location", prefix+"/blobs/"+blobDigest.String())
+		w.Header().Set("Docker-Content-Digest", blobDigest.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *FakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request) {
+	_, blobDigest, _ := strings.Cut(req.URL.Path, "/blobs/")
+	data, ok := r.blobs[digest.Digest(blobDigest)]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Header().Set("Docker-Content-Digest", blobDigest)
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (r *FakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request) {
+	repoName, reference, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/")
+	separator := ":"
+	if strings.Contains(reference, ":") {
+		separator = "@"
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		manifestDigest := digest.FromBytes(body)
+		stored := FakeManifest{MediaType: req.Header.Get("Content-Type"), Content: body}
+		r.manifests[repoName+separator+reference] = stored
+		r.manifests[repoName+"@"+manifestDigest.String()] = stored
+		w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		stored, ok := r.manifests[repoName+separator+reference]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", stored.MediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(stored.Content)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(stored.Content).String())
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(stored.Content)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
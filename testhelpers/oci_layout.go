@@ -0,0 +1,74 @@
+package testhelpers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// WriteOCILayout stores a single-platform image in an OCI image layout at dir
+// under the given name and returns its manifest digest.
+func WriteOCILayout(dir, name string, config v1.Image, layers ...[]byte) (digest.Digest, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return "", err
+	}
+
+	writeBlob := func(mediaType string, content []byte) (v1.Descriptor, error) {
+		blobDigest := digest.FromBytes(content)
+		err := os.WriteFile(filepath.Join(dir, "blobs", "sha256", blobDigest.Encoded()), content, 0644)
+		return v1.Descriptor{MediaType: mediaType, Digest: blobDigest, Size: int64(len(content))}, err
+	}
+	writeJSONBlob := func(mediaType string, value interface{}) (v1.Descriptor, error) {
+		content, err := json.Marshal(value)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		return writeBlob(mediaType, content)
+	}
+
+	layerDescriptors := []v1.Descriptor{}
+	for _, layer := range layers {
+		descriptor, err := writeBlob(v1.MediaTypeImageLayerGzip, layer)
+		if err != nil {
+			return "", err
+		}
+		layerDescriptors = append(layerDescriptors, descriptor)
+	}
+
+	configDescriptor, err := writeJSONBlob(v1.MediaTypeImageConfig, config)
+	if err != nil {
+		return "", err
+	}
+	manifestDescriptor, err := writeJSONBlob(v1.MediaTypeImageManifest, v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDescriptor,
+		Layers:    layerDescriptors,
+	})
+	if err != nil {
+		return "", err
+	}
+	manifestDescriptor.Annotations = map[string]string{v1.AnnotationRefName: name}
+
+	index, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{manifestDescriptor},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, v1.ImageIndexFile), index, 0644); err != nil {
+		return "", err
+	}
+
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return "", err
+	}
+	return manifestDescriptor.Digest, os.WriteFile(filepath.Join(dir, v1.ImageLayoutFile), layout, 0644)
+}
@@ -0,0 +1 @@
+package testhelpers // import "code.cloudfoundry.org/dockerapplifecycle/testhelpers"